@@ -10,10 +10,21 @@ import (
 	"Core"
 	"FileParser"
 	"Logging"
+	"crypto/hmac"
 	"crypto/sha512"
 	"fmt"
 	"strings"
+	"sync"
 )
+/**
+  Sign in message is user name, timestamp, nonce and proof
+  Proof is hmac sha512 of user name, timestamp and nonce
+  with encoded password as key, so password is never sent
+**/
+const UserNameLength = 128
+const TimestampLength = 8
+const NonceLength = 16
+const ProofLength = 128
 /**
   userPasswordMap struct will have 
   a map to store user name and password
@@ -42,6 +53,11 @@ func (s *userPasswordMap) Add(args ...interface{}) {
   default construtor for map
 **/
 var record = userPasswordMap{make(map[string]string), false}
+/**
+  Users in this set are not allowed to sign in
+  even if their user name and password are correct
+**/
+var disabledUsers sync.Map
 /**
    This function simply load CSV
 **/
@@ -65,6 +81,10 @@ func Verify(username, password string) (bool, error) {
 		return false, nil //todo make a error
 	}
 	value, ok := record.userPassword[username]
+	if IsDisabled(username) {
+		Logging.NormalLogger.Println("user is disabled")
+		return false, nil
+	}
 	if ok && password == value {
 		Logging.NormalLogger.Println("user login")
 	} else {
@@ -72,6 +92,68 @@ func Verify(username, password string) (bool, error) {
 	}
 	return ok && password == value, nil
 }
+/**
+   Make proof of sign in with encoded user name and password
+**/
+func MakeProof(username, password string, timestamp, nonce []byte) string {
+	mac := hmac.New(sha512.New, Core.ConvertStringTOByte(password))
+	mac.Write(Core.ConvertStringTOByte(username))
+	mac.Write(timestamp)
+	mac.Write(nonce)
+	return convert2Hex(mac.Sum(nil))
+}
+/**
+   This function verify the proof is made by the password of this user
+   Disabled users are refused like Verify
+**/
+func VerifyProof(username string, timestamp, nonce []byte, proof string) (bool, error) {
+	Logging.NormalLogger.Println("going to verify given username and proof")
+	if !record.loaded {
+		return false, nil
+	}
+	if IsDisabled(username) {
+		Logging.NormalLogger.Println("user is disabled")
+		return false, nil
+	}
+	value, ok := record.userPassword[username]
+	if !ok {
+		// still compute a proof so that unknown user takes the same time
+		value = username
+	}
+	expected := MakeProof(username, value, timestamp, nonce)
+	if !ok || !hmac.Equal(Core.ConvertStringTOByte(expected), Core.ConvertStringTOByte(proof)) {
+		Logging.NormalLogger.Println("wrong username or password")
+		return false, nil
+	}
+	Logging.NormalLogger.Println("user login")
+	return true, nil
+}
+/**
+   Disable an encoded user name, it will be refused by Verify
+**/
+func DisableUser(username string) {
+	disabledUsers.Store(username, true)
+}
+/**
+   Allow an encoded user name to sign in again
+**/
+func EnableUser(username string) {
+	disabledUsers.Delete(username)
+}
+/**
+   Check the encoded user name has been disabled or not
+**/
+func IsDisabled(username string) bool {
+	_, ok := disabledUsers.Load(username)
+	return ok
+}
+/**
+   Check the encoded user name is in CSV
+**/
+func HasUser(username string) bool {
+	_, ok := record.userPassword[username]
+	return ok
+}
 /**
    Run specific algorithm 
    And takes couple strings
@@ -110,3 +192,14 @@ func EncodeUsername(username string) string {
 	sha.Write(Core.ConvertStringTOByte(username))
 	return convert2Hex(sha.Sum(nil))
 }
+/**
+   Config and admin api take a plain user name or an encoded one
+   An encoded name is 128 upper case hex chars, it is kept as it is
+   Every other name is encoded
+**/
+func NormalizeUsername(username string) string {
+	if len(username) == UserNameLength && strings.Trim(username, "0123456789ABCDEF") == "" {
+		return username
+	}
+	return EncodeUsername(username)
+}
@@ -8,7 +8,11 @@ package Core
 import (
 	"Encryption"
 	"Logging"
+	"encoding/binary"
+	"errors"
+	"io"
 	"net"
+	"sync/atomic"
 )
 /**
   We assign different int to Server Local and different types
@@ -23,27 +27,35 @@ const (
 	type0 = iota
 	type1 = iota
 )
-/**
-  For each connection we have heartbeat thread to send it every 5 seconds
-  And read it also 5 seconds, if after 1 second sp does not receive heartbeat
-  we think we can close this session
-**/
-const HeartBeatRate = 5
-const HeartBeatTimeout = 1
-
 /**
   Add each type for socks5 ATYPE field
 **/
 const IpV4 = 0x1
 const DomainName = 0x3
 const IpV6 = 0x4
+/**
+  Socks5 version, command and reply fields
+**/
+const SocksVersion = 0x5
+const SocksNoAuth = 0x0
+const SocksConnect = 0x1
+const SocksSucceeded = 0x0
+const SocksGeneralFailure = 0x1
+const SocksNotAllowed = 0x2
+const SocksNetworkUnreachable = 0x3
+const SocksHostUnreachable = 0x4
+const SocksCommandNotSupported = 0x7
+/**
+  Command which only local proxy sends to server proxy
+  It takes a conn which server proxy accepted for a reverse tunnel, the name of address is the id of that conn
+**/
+const SocksReverse = 0x80
 /**
    FAIL AND SUCCESS are used for password and username verification
-   BEAT is used for content from heartbeat message 
+   Heartbeat messages are control frames in coreControl.go
 **/
 var FAIL = []byte{0x3, 0x2, 0x1}
 var SUCCESS = []byte{0x1, 0x2, 0x3}
-var BEAT = []byte{0xff, 0xff, 0xff}
 /**
   This function just compare two byte array's value
 **/
@@ -77,9 +89,9 @@ func ConvertByteTOString(bt []byte) string {
  we used it when pass decode and encode table
  we used it when send username and password
 **/
-func ReadAll(buffer []byte, socket *net.TCPConn, size int) (int, error) {
+func ReadAll(buffer []byte, socket net.Conn, size int) (int, error) {
 	// 256 is one packet size
-	readLength, err := socket.Read(buffer)
+	readLength, err := socket.Read(buffer[:size])
 	if err != nil {
 		return -1, err
 	}
@@ -101,9 +113,9 @@ func ReadAll(buffer []byte, socket *net.TCPConn, size int) (int, error) {
  we used it when pass decode and encode table
  we used it when send username and password
 **/
-func WriteAll(buffer []byte, socket *net.TCPConn, size int) (int, error) {
+func WriteAll(buffer []byte, socket net.Conn, size int) (int, error) {
 	// 256 is one packet size
-	writeLength, err := socket.Write(buffer)
+	writeLength, err := socket.Write(buffer[:size])
 	if err != nil {
 		return -1, err
 	}
@@ -120,66 +132,180 @@ func WriteAll(buffer []byte, socket *net.TCPConn, size int) (int, error) {
 	return size, nil
 
 }
+/**
+	+--------+-----------+
+	| LENGTH |  PAYLOAD  |
+	+--------+-----------+
+	|   2    |  LENGTH   |
+	+--------+-----------+
+ After socks5 request and reply, data between two proxies is sent in frames
+ Header and payload are both encoded
+ A frame with length 0 means the sender will not send anything anymore (half close)
+**/
+const frameHeaderLength = 2
+
 /**
  This function is used for transfer all data between different hosts and proxies
  It will Write all data in read buffer, and send it to correct destinations
  device can be local and server
  type can be 0 and 1    0 means works as a server, 1 means works as a client
+ counter is increased by the number of bytes which are written successfully
+ table can be nil when the connection does not go through server proxy
+ activity is shared by both directions for idle timeout, it can be nil
+ Buffer comes from buffer pool and is encoded or decoded in place
+ so there is no allocation for each read
+ It returns nil when the direction is finished normally and the peer is half closed
+**/
+func Transfer(table *Encryption.Table, conn1, conn2 net.Conn, device, types int, counter *int64, a *activity) error {
+	if table == nil {
+		return transferPlain(conn1, conn2, device, types, counter, a)
+	}
+	// if it is local and works as a server
+	// or if it is server and works as a client
+	if (device == Local && types == type0) || (device == Server && types == type1) {
+		return transferToTunnel(table, conn1, conn2, device, types, counter, a)
+	}
+	// if it is a local and works as a client
+	// or it is a server and works as a server
+	return transferFromTunnel(table, conn1, conn2, device, types, counter, a)
+}
+
+/**
+ Read from user application or real server, and send frames to the other proxy
+ When reading is finished, a frame with length 0 is sent
 **/
-func Transfer(table *Encryption.Table, conn1, conn2 *net.TCPConn, device, types int) {
+func transferToTunnel(table *Encryption.Table, conn1, conn2 net.Conn, device, types int, counter *int64, a *activity) error {
+	buffer := GetBuffer()
+	defer PutBuffer(buffer)
+	request := *buffer
 	for {
-		request := make([]byte, 2048)
-		readLen, err := conn1.Read(request)
-		// we need to use proxy to
+		if err := a.beforeRead(conn1); err != nil {
+			return err
+		}
+		readLen, err := conn1.Read(request[frameHeaderLength:])
+		if readLen > 0 {
+			a.touch()
+			binary.BigEndian.PutUint16(request[0:frameHeaderLength], uint16(readLen))
+			table.EncodeInPlace(request[:frameHeaderLength+readLen])
+			// we send this byte to sp
+			if errs := a.writeFull(conn2, request[:frameHeaderLength+readLen]); errs != nil {
+				Logging.NormalLogger.Println("device and types", device, types, "got an error when writing request")
+				return errs
+			}
+			atomic.AddInt64(counter, int64(readLen))
+		}
+		if err == io.EOF {
+			// connection close by user
+			Logging.NormalLogger.Println("device and types", device, types, "connection closed by user")
+			request[0], request[1] = 0, 0
+			table.EncodeInPlace(request[:frameHeaderLength])
+			return a.writeFull(conn2, request[:frameHeaderLength])
+		}
 		if err != nil {
+			retry, errs := a.check(err)
+			if retry {
+				continue
+			}
 			Logging.NormalLogger.Println("device and types", device, types, "got an error when reading request", "get length", readLen)
-			Logging.ErrorLogger.Println(err)
-			break
+			return errs
 		}
-		// connection close by user
+	}
+}
+
+/**
+ Read frames from the other proxy, and send payload to user application or real server
+ A frame with length 0 half closes the peer by CloseWrite
+**/
+func transferFromTunnel(table *Encryption.Table, conn1, conn2 net.Conn, device, types int, counter *int64, a *activity) error {
+	buffer := GetBuffer()
+	defer PutBuffer(buffer)
+	request := *buffer
+	for {
+		if err := a.readFull(conn1, request[:frameHeaderLength]); err != nil {
+			Logging.NormalLogger.Println("device and types", device, types, "got an error when reading frame")
+			return err
+		}
+		table.DecodeInPlace(request[:frameHeaderLength])
+		readLen := int(binary.BigEndian.Uint16(request[0:frameHeaderLength]))
 		if readLen == 0 {
-			Logging.NormalLogger.Println("device and types", device, types, "connection closed by user")
-			break
+			Logging.NormalLogger.Println("device and types", device, types, "connection closed by other proxy")
+			return closeWrite(conn2)
 		}
-
-		// if it is local and works as a server
-		// or if it is server and works as a client
-		if (device == Local && types == type0) || (device == Server && types == type1) {
-			request = table.Encode(request)
+		if readLen > len(request) {
+			return errors.New("frame is longer than buffer")
 		}
-		// if it is a local and works as a client
-		// or it is a server and works as a server
-
-		if (device == Local && types == type1) || (device == Server && types == type0) {
-			request = table.Decode(request)
+		if err := a.readFull(conn1, request[:readLen]); err != nil {
+			Logging.NormalLogger.Println("device and types", device, types, "got an error when reading frame")
+			return err
 		}
-
-		// we send this byte to sp
-		numbers,errs := WriteAll(request[0:readLen], conn2, readLen)
-		if numbers == -1 && errs != nil {
+		table.DecodeInPlace(request[:readLen])
+		if err := a.writeFull(conn2, request[:readLen]); err != nil {
 			Logging.NormalLogger.Println("device and types", device, types, "got an error when writing request")
-			Logging.ErrorLogger.Println(err)
-			break
+			return err
 		}
-		/**
-		writeLength, err := conn2.Write(request[0:readLen])
-		if err != nil {
-			Logging.NormalLogger.Println("device and types", device, types, "got an error when writing request")
-			Logging.ErrorLogger.Println(err)
-			break
+		atomic.AddInt64(counter, int64(readLen))
+	}
+}
+
+/**
+ Without encryption and idle timeout data is copied by io.CopyBuffer
+ TCPConn uses splice on linux in this case, so data does not go through user space
+ Counter is only increased when the copy is finished
+ With idle timeout data is copied by reads and writes with deadlines
+ The peer is half closed when reading is finished
+**/
+func transferPlain(conn1, conn2 net.Conn, device, types int, counter *int64, a *activity) error {
+	buffer := GetBuffer()
+	defer PutBuffer(buffer)
+	var err error
+	if a == nil || a.timeout == 0 {
+		var numbers int64
+		numbers, err = io.CopyBuffer(conn2, conn1, *buffer)
+		atomic.AddInt64(counter, numbers)
+	} else {
+		err = copyWithActivity(conn1, conn2, *buffer, counter, a)
+	}
+	if err != nil {
+		Logging.NormalLogger.Println("device and types", device, types, "got an error when copying request")
+		return err
+	}
+	Logging.NormalLogger.Println("device and types", device, types, "connection closed by user")
+	return closeWrite(conn2)
+}
+
+/**
+ Copy until EOF, counter is increased after each write
+**/
+func copyWithActivity(conn1, conn2 net.Conn, buffer []byte, counter *int64, a *activity) error {
+	for {
+		if err := a.beforeRead(conn1); err != nil {
+			return err
 		}
-		for writeLength != readLen {
-			if writeLength != readLen {
-				Logging.NormalLogger.Printf("*******************\n")
-				twiceLength, err := conn2.Write(request[writeLength:readLen])
-				if err != nil {
-					Logging.NormalLogger.Println("device and types", device, types, "got an error when writing request")
-					Logging.ErrorLogger.Println(err)
-					break
-				}
-				writeLength += twiceLength
+		readLen, err := conn1.Read(buffer)
+		if readLen > 0 {
+			a.touch()
+			if errs := a.writeFull(conn2, buffer[:readLen]); errs != nil {
+				return errs
 			}
+			atomic.AddInt64(counter, int64(readLen))
 		}
-		**/
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			if retry, errs := a.check(err); !retry {
+				return errs
+			}
+		}
+	}
+}
+
+/**
+ Half close a conn, conns of some transports can not be half closed so they are fully closed
+**/
+func closeWrite(conn net.Conn) error {
+	if tcpConn, ok := conn.(interface{ CloseWrite() error }); ok {
+		return tcpConn.CloseWrite()
 	}
+	return conn.Close()
 }
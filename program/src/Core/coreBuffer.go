@@ -0,0 +1,40 @@
+package Core
+
+/**
+  Author: JiaCheng Yang && Wenkai Zheng
+  This file is used for the buffer pool of transfer
+  Buffers are reused between connections so that transfer does not allocate
+**/
+import "sync"
+
+/**
+  Size of one relay buffer, it is big enough for most tcp reads
+**/
+const RelayBufferSize = 32 * 1024
+
+/**
+  Pool keeps pointers so that putting them back does not allocate
+**/
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		buffer := make([]byte, RelayBufferSize)
+		return &buffer
+	},
+}
+
+/**
+  Get a relay buffer from pool
+**/
+func GetBuffer() *[]byte {
+	return bufferPool.Get().(*[]byte)
+}
+
+/**
+  Give a relay buffer back to pool
+**/
+func PutBuffer(buffer *[]byte) {
+	if len(*buffer) != RelayBufferSize {
+		return
+	}
+	bufferPool.Put(buffer)
+}
@@ -0,0 +1,129 @@
+package Core
+
+/**
+  Author: JiaCheng Yang && Wenkai Zheng
+  Benchmarks of relay directions, each op relays one MB
+  Conns are in memory, so only buffer pool, encoding and framing are measured
+  Run with: go test -bench . -benchmem Core
+**/
+import (
+	"Encryption"
+	"Logging"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+const benchPayload = 1 << 20
+
+/**
+  Conn which reads from data and throws away what is written
+  It allocates nothing, so allocations of a benchmark come from relay
+**/
+type benchConn struct {
+	data    []byte
+	offset  int
+	written int64
+}
+
+func (c *benchConn) Read(p []byte) (int, error) {
+	if c.offset == len(c.data) {
+		return 0, io.EOF
+	}
+	n := copy(p, c.data[c.offset:])
+	c.offset += n
+	return n, nil
+}
+
+func (c *benchConn) Write(p []byte) (int, error) {
+	c.written += int64(len(p))
+	return len(p), nil
+}
+
+func (c *benchConn) CloseWrite() error                  { return nil }
+func (c *benchConn) Close() error                       { return nil }
+func (c *benchConn) LocalAddr() net.Addr                { return &net.TCPAddr{} }
+func (c *benchConn) RemoteAddr() net.Addr               { return &net.TCPAddr{} }
+func (c *benchConn) SetDeadline(t time.Time) error      { return nil }
+func (c *benchConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *benchConn) SetWriteDeadline(t time.Time) error { return nil }
+
+/**
+  Payload of one op split into encoded frames, the way the other proxy sends it
+**/
+func makeFrames(table *Encryption.Table, payload []byte) []byte {
+	var frames []byte
+	for len(payload) > 0 {
+		size := RelayBufferSize - frameHeaderLength
+		if size > len(payload) {
+			size = len(payload)
+		}
+		header := make([]byte, frameHeaderLength)
+		binary.BigEndian.PutUint16(header, uint16(size))
+		frames = append(frames, table.Encode(header)...)
+		frames = append(frames, table.Encode(payload[:size])...)
+		payload = payload[size:]
+	}
+	return append(frames, table.Encode([]byte{0, 0})...)
+}
+
+func runRelay(b *testing.B, data []byte, relay func(source, sink *benchConn, counter *int64) error) {
+	Logging.NormalLogger.SetOutput(io.Discard)
+	source, sink := &benchConn{data: data}, &benchConn{}
+	var counter int64
+	b.SetBytes(benchPayload)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		source.offset = 0
+		if err := relay(source, sink, &counter); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	if counter != int64(b.N)*benchPayload {
+		b.Fatalf("relayed %d bytes, want %d", counter, int64(b.N)*benchPayload)
+	}
+}
+
+/**
+  User application to tunnel, data is framed and encoded in place
+**/
+func BenchmarkTransferToTunnel(b *testing.B) {
+	table := Encryption.NewEncryptionTable()
+	runRelay(b, make([]byte, benchPayload), func(source, sink *benchConn, counter *int64) error {
+		return transferToTunnel(table, source, sink, Local, type0, counter, nil)
+	})
+}
+
+/**
+  Tunnel to user application, frames are decoded in place
+**/
+func BenchmarkTransferFromTunnel(b *testing.B) {
+	table := Encryption.NewEncryptionTable()
+	frames := makeFrames(table, make([]byte, benchPayload))
+	runRelay(b, frames, func(source, sink *benchConn, counter *int64) error {
+		return transferFromTunnel(table, source, sink, Local, type1, counter, nil)
+	})
+}
+
+/**
+  Direct connections without encryption and idle timeout
+**/
+func BenchmarkTransferPlain(b *testing.B) {
+	runRelay(b, make([]byte, benchPayload), func(source, sink *benchConn, counter *int64) error {
+		return transferPlain(source, sink, Local, type0, counter, nil)
+	})
+}
+
+/**
+  Direct connections with idle timeout, they are copied by reads and writes with deadlines
+**/
+func BenchmarkTransferPlainIdle(b *testing.B) {
+	a := newActivity(time.Minute)
+	runRelay(b, make([]byte, benchPayload), func(source, sink *benchConn, counter *int64) error {
+		return transferPlain(source, sink, Local, type0, counter, a)
+	})
+}
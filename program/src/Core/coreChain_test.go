@@ -0,0 +1,292 @@
+package Core
+
+/**
+  Author: JiaCheng Yang && Wenkai Zheng
+  Tests of chains against stand-in socks5 and http proxies on 127.0.0.1
+  The last proxy connects to an echo server, so a chain works when the echo comes back
+**/
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+/**
+  Listen on a free port and handle each conn in a go routine, the listener is closed by cleanup
+**/
+func standIn(t *testing.T, handle func(conn net.Conn)) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go handle(conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func echoServer(t *testing.T) string {
+	return standIn(t, func(conn net.Conn) {
+		defer conn.Close()
+		_, _ = io.Copy(conn, conn)
+	})
+}
+
+/**
+  Copy both ways until one side is done, reader has bytes which the proxy read already
+**/
+func pipe(client net.Conn, reader io.Reader, address string) {
+	defer client.Close()
+	target, err := net.Dial("tcp", address)
+	if err != nil {
+		return
+	}
+	defer target.Close()
+	go func() {
+		_, _ = io.Copy(target, reader)
+		_ = closeWrite(target)
+	}()
+	_, _ = io.Copy(client, target)
+}
+
+/**
+  Socks5 proxy, user name and password are asked when user is not empty
+**/
+func socksStandIn(t *testing.T, user, password string) string {
+	return standIn(t, func(conn net.Conn) {
+		greeting := make([]byte, 2)
+		if _, err := io.ReadFull(conn, greeting); err != nil {
+			_ = conn.Close()
+			return
+		}
+		methods := make([]byte, greeting[1])
+		if _, err := io.ReadFull(conn, methods); err != nil {
+			_ = conn.Close()
+			return
+		}
+		method := byte(SocksNoAuth)
+		if user != "" {
+			method = socksNoAcceptable
+			if strings.IndexByte(string(methods), socksUserPassword) >= 0 {
+				method = socksUserPassword
+			}
+		}
+		_, _ = conn.Write([]byte{SocksVersion, method})
+		if method == socksNoAcceptable {
+			_ = conn.Close()
+			return
+		}
+		if method == socksUserPassword {
+			reader := bufio.NewReader(conn)
+			header := make([]byte, 2)
+			_, _ = io.ReadFull(reader, header)
+			name := make([]byte, header[1])
+			_, _ = io.ReadFull(reader, name)
+			length, _ := reader.ReadByte()
+			secret := make([]byte, length)
+			_, _ = io.ReadFull(reader, secret)
+			if string(name) != user || string(secret) != password {
+				_, _ = conn.Write([]byte{0x1, 0x1})
+				_ = conn.Close()
+				return
+			}
+			_, _ = conn.Write([]byte{0x1, 0x0})
+		}
+		request := make([]byte, 3)
+		if _, err := io.ReadFull(conn, request); err != nil {
+			_ = conn.Close()
+			return
+		}
+		target, err := ReadSocksAddr(conn, nil)
+		if err != nil {
+			_ = conn.Close()
+			return
+		}
+		_, _ = conn.Write([]byte{SocksVersion, SocksSucceeded, 0x00, IpV4, 0, 0, 0, 0, 0, 0})
+		pipe(conn, conn, target.String())
+	})
+}
+
+/**
+  Http proxy which only knows CONNECT, user name and password are asked when user is not empty
+**/
+func httpStandIn(t *testing.T, user, password string) string {
+	credential := "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+	return standIn(t, func(conn net.Conn) {
+		reader := bufio.NewReader(conn)
+		request, err := http.ReadRequest(reader)
+		if err != nil || request.Method != http.MethodConnect {
+			_ = conn.Close()
+			return
+		}
+		if user != "" && request.Header.Get("Proxy-Authorization") != credential {
+			_, _ = conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"))
+			_ = conn.Close()
+			return
+		}
+		_, _ = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		pipe(conn, reader, request.Host)
+	})
+}
+
+/**
+  Resolver of tests, addresses of the first proxy are ips
+**/
+func resolveIP(target *SocksAddr) ([]*net.TCPAddr, error) {
+	return (&Proxy{}).ResolveTCPAddrs(target)
+}
+
+/**
+  Send a message through conn and read it back from echo server
+**/
+func checkEcho(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	message := []byte("through the chain")
+	if _, err := conn.Write(message); err != nil {
+		t.Fatal(err)
+	}
+	echo := make([]byte, len(message))
+	if _, err := io.ReadFull(conn, echo); err != nil {
+		t.Fatal(err)
+	}
+	if string(echo) != string(message) {
+		t.Fatalf("got %q, want %q", echo, message)
+	}
+}
+
+/**
+  Each proxy alone and chains of both kinds, with and without passwords
+**/
+func TestChainDial(t *testing.T) {
+	target := echoServer(t)
+	socks := socksStandIn(t, "", "")
+	socksAuth := socksStandIn(t, "alice", "secret")
+	httpProxy := httpStandIn(t, "", "")
+	httpAuth := httpStandIn(t, "bob", "secret")
+	timeouts := Timeouts{Connect: 5 * time.Second}
+	for _, proxies := range [][]string{
+		{"socks5://" + socks},
+		{"socks5://alice:secret@" + socksAuth},
+		{"http://" + httpProxy},
+		{"http://bob:secret@" + httpAuth},
+		{"socks5://alice:secret@" + socksAuth, "http://bob:secret@" + httpAuth, "socks5://" + socks},
+		{"http://" + httpProxy, "socks5://" + socks},
+	} {
+		chain, err := NewChain(proxies)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := chain.Dial(target, resolveIP, timeouts, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", chain, err)
+		}
+		checkEcho(t, conn)
+	}
+}
+
+/**
+  Wrong or missing passwords fail the dial
+**/
+func TestChainDialRefused(t *testing.T) {
+	target := echoServer(t)
+	socksAuth := socksStandIn(t, "alice", "secret")
+	httpAuth := httpStandIn(t, "bob", "secret")
+	for _, proxies := range [][]string{
+		{"socks5://" + socksAuth},
+		{"socks5://alice:wrong@" + socksAuth},
+		{"http://bob:wrong@" + httpAuth},
+		{"http://" + httpAuth},
+	} {
+		chain, err := NewChain(proxies)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conn, err := chain.Dial(target, resolveIP, Timeouts{Connect: 5 * time.Second}, nil); err == nil {
+			_ = conn.Close()
+			t.Fatalf("%s: dial worked without the right password", proxies[0])
+		}
+	}
+}
+
+/**
+  The first proxy is a name, it is resolved by the given resolver and every address is tried
+**/
+func TestChainDialResolvesFirstProxy(t *testing.T) {
+	target := echoServer(t)
+	socks := socksStandIn(t, "", "")
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := closed.Addr().(*net.TCPAddr)
+	_ = closed.Close()
+	up, err := net.ResolveTCPAddr("tcp", socks)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chain, err := NewChain([]string{"socks5://proxy.test:" + strconv.Itoa(up.Port)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var asked *SocksAddr
+	resolve := func(first *SocksAddr) ([]*net.TCPAddr, error) {
+		asked = first
+		return []*net.TCPAddr{down, up}, nil
+	}
+	conn, err := chain.Dial(target, resolve, Timeouts{Connect: 5 * time.Second}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEcho(t, conn)
+	if asked == nil || asked.Type != DomainName || asked.Name != "proxy.test" || asked.Port != up.Port {
+		t.Fatalf("resolver was asked for %v", asked)
+	}
+}
+
+/**
+  A proxy which never replies is left after handshake timeout when there is no connect timeout
+**/
+func TestChainDialHandshakeDeadline(t *testing.T) {
+	stalled := standIn(t, func(conn net.Conn) {
+		defer conn.Close()
+		_, _ = io.Copy(io.Discard, conn)
+	})
+	chain, err := NewChain([]string{"socks5://" + stalled})
+	if err != nil {
+		t.Fatal(err)
+	}
+	target := echoServer(t)
+	done := make(chan error, 1)
+	go func() {
+		conn, err := chain.Dial(target, resolveIP, Timeouts{Handshake: 200 * time.Millisecond}, nil)
+		if err == nil {
+			_ = conn.Close()
+		}
+		done <- err
+	}()
+	select {
+	case err = <-done:
+		if err == nil {
+			t.Fatal("dial worked through a stalled proxy")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("dial has no handshake deadline")
+	}
+}
@@ -10,18 +10,34 @@ import (
 	"Logging"
 	"errors"
 	"net"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
+/**
+   Every connection handler gets an unique id so that
+   it can be found again (for example by the admin api)
+**/
+var nextConnectionId uint64
+
 /**
    Each TcpConn is wokring as same way as socket,and they can read write directly.
    Each complete is used for joining thread
    Each isRunning is used for checking proxy's status
    Encryption table is used for decode and encode
+   Upload and download bytes are counted while transferring
+   Activity is shared by both directions for idle timeout
+   Close reason is the first reason given when this connection is closed
 **/
 type ConnectionHandler struct {
-	localTcpConn          *net.TCPConn
-	serverTcpConn         *net.TCPConn
+	id                    uint64
+	createdAt             time.Time
+	target                string
+	uploadBytes           int64
+	downloadBytes         int64
+	localTcpConn          net.Conn
+	serverTcpConn         net.Conn
 	localTcpComplete      chan int
 	serverTcpComplete     chan int
 	isLocalRunning        bool
@@ -30,13 +46,20 @@ type ConnectionHandler struct {
 	encryptionTable       *Encryption.Table
 	isLocalTcpConnClosed  int32
 	isServerTcpConnClosed int32
+	activity              *activity
+	lifetime              time.Duration
+	reasonMutex           sync.Mutex
+	closeReason           string
 }
 
 /**
    Simple constructor for connection handler
 **/
-func NewConnectionHandler(local, server *net.TCPConn, device int, table *Encryption.Table) *ConnectionHandler {
+func NewConnectionHandler(local, server net.Conn, device int, table *Encryption.Table) *ConnectionHandler {
 	return &ConnectionHandler{
+		id:                    atomic.AddUint64(&nextConnectionId, 1),
+		createdAt:             time.Now(),
+		target:                server.RemoteAddr().String(),
 		localTcpConn:          local,
 		serverTcpConn:         server,
 		localTcpComplete:      make(chan int),
@@ -50,10 +73,31 @@ func NewConnectionHandler(local, server *net.TCPConn, device int, table *Encrypt
 	}
 }
 
+/**
+   Set idle timeout and lifetime before transferring data, zero means no timeout
+**/
+func (h *ConnectionHandler) SetTimeouts(idle, lifetime time.Duration) {
+	if idle > 0 {
+		h.activity = newActivity(idle)
+	}
+	h.lifetime = lifetime
+}
+
+/**
+   Reason of an error from transfer, idle timeout has its own reason
+**/
+func transferCloseReason(err error) string {
+	if err == errIdleTimeout {
+		return CloseIdle
+	}
+	return "error: " + err.Error()
+}
+
 /**
    We assgin proxy's corrected device and type to transfer function in core.go
    When there is any error occure we will close this connection and
    join the parent thread (read from left to right ) app to remote server
+   When it finishes normally only this direction is closed (half close)
 **/
 
 func (h *ConnectionHandler) transferRequest() error {
@@ -63,8 +107,10 @@ func (h *ConnectionHandler) transferRequest() error {
 	}
 	h.isServerRunning = true
 	h.serverTcpComplete <- 0
-	Transfer(h.encryptionTable, h.localTcpConn, h.serverTcpConn, h.device, type0)
-	var e = h.closeLocalConnection()
+	var e = Transfer(h.encryptionTable, h.localTcpConn, h.serverTcpConn, h.device, type0, &h.uploadBytes, h.activity)
+	if e != nil {
+		h.Close(transferCloseReason(e))
+	}
 	Logging.NormalLogger.Print("deal as server terminates")
 	h.serverTcpComplete <- 0
 	return e
@@ -74,6 +120,7 @@ func (h *ConnectionHandler) transferRequest() error {
    We assgin proxy's corrected device and type to transfer function in core.go
    When there is any error occure we will close this connection and
    join the parent thread (read from right to left ) remote server to app
+   When it finishes normally only this direction is closed (half close)
 **/
 func (h *ConnectionHandler) transferRespond() error {
 	Logging.NormalLogger.Print("Going to transfer respond ")
@@ -82,8 +129,10 @@ func (h *ConnectionHandler) transferRespond() error {
 	}
 	h.isLocalRunning = true
 	h.localTcpComplete <- 0
-	Transfer(h.encryptionTable, h.serverTcpConn, h.localTcpConn, h.device, type1)
-	var e = h.closeServerConnection()
+	var e = Transfer(h.encryptionTable, h.serverTcpConn, h.localTcpConn, h.device, type1, &h.downloadBytes, h.activity)
+	if e != nil {
+		h.Close(transferCloseReason(e))
+	}
 	Logging.NormalLogger.Print("deal as client terminates")
 	h.localTcpComplete <- 0
 	return e
@@ -95,6 +144,12 @@ func (h *ConnectionHandler) transferRespond() error {
    Makesure response and request thread are running before waiting
 **/
 func (h *ConnectionHandler) TransferData() {
+	if h.lifetime > 0 {
+		timer := time.AfterFunc(h.lifetime, func() {
+			h.Close(CloseLifetime)
+		})
+		defer timer.Stop()
+	}
 	go func() {
 		if err := h.transferRequest(); err != nil {
 			Logging.ErrorLogger.Println(err)
@@ -116,6 +171,7 @@ func (h *ConnectionHandler) TransferData() {
    This functions will be called after response and request thread is running
    And it will finished after  response and request thread are finished
    Makesure response and request thread is already running in here
+   Both tcp conns are closed only when both directions are finished
 **/
 func (h *ConnectionHandler) Wait() error {
 	Logging.NormalLogger.Print("Going to wait client and server ")
@@ -129,13 +185,80 @@ func (h *ConnectionHandler) Wait() error {
 	<-h.serverTcpComplete
 	h.isLocalRunning = false
 	h.isServerRunning = false
+	h.Close(CloseFinished)
 	return nil
 }
 
+/**
+   Simple getter for id
+**/
+func (h *ConnectionHandler) GetId() uint64 {
+	return h.id
+}
+
+/**
+   Simple getter for the time this connection was created
+**/
+func (h *ConnectionHandler) GetCreatedAt() time.Time {
+	return h.createdAt
+}
+
+/**
+   Simple getter for target, by default it is the remote
+   address of server side tcp conn
+**/
+func (h *ConnectionHandler) GetTarget() string {
+	return h.target
+}
+
+/**
+   Simple setter for target
+**/
+func (h *ConnectionHandler) SetTarget(target string) {
+	h.target = target
+}
+
+/**
+   Bytes read from local side and written to server side
+**/
+func (h *ConnectionHandler) GetUploadBytes() int64 {
+	return atomic.LoadInt64(&h.uploadBytes)
+}
+
+/**
+   Bytes read from server side and written to local side
+**/
+func (h *ConnectionHandler) GetDownloadBytes() int64 {
+	return atomic.LoadInt64(&h.downloadBytes)
+}
+
+/**
+   Simple getter for close reason, it is empty while the connection is open
+**/
+func (h *ConnectionHandler) GetCloseReason() string {
+	h.reasonMutex.Lock()
+	defer h.reasonMutex.Unlock()
+	return h.closeReason
+}
+
 /**
    Simple close Tcp connection
 **/
 func (h *ConnectionHandler) Abort() {
+	h.Close(CloseAborted)
+}
+
+/**
+   Close Tcp connection and record the reason
+   Only the first reason is kept because later errors are caused by closing
+**/
+func (h *ConnectionHandler) Close(reason string) {
+	h.reasonMutex.Lock()
+	if h.closeReason == "" {
+		h.closeReason = reason
+		Logging.NormalLogger.Println("connection", h.id, "to", h.target, "is closed:", reason)
+	}
+	h.reasonMutex.Unlock()
 	_ = h.closeLocalConnection()
 	_ = h.closeServerConnection()
 }
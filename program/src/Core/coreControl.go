@@ -0,0 +1,303 @@
+package Core
+
+/**
+  Author: JiaCheng Yang && Wenkai Zheng
+  This file is used for the control connection between local proxy and server proxy
+  Every message is a frame which is encoded by encryption table
+  Ping and pong frames keep both sides knowing the other side is alive
+**/
+import (
+	"Encryption"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+/**
+	+------+--------+-----------+
+	| TYPE | LENGTH |  PAYLOAD  |
+	+------+--------+-----------+
+	|  1   |   2    |  LENGTH   |
+	+------+--------+-----------+
+  Whole frame is encoded
+  Ping payload is sequence number (4 bytes) and send time in nanoseconds (8 bytes)
+  Pong payload is the same as the ping it answers
+  Dns query payload is a dns message from local proxy, dns answer is the response with the same id
+  Reverse open payload is a port (2 bytes) which local proxy asks server proxy to listen on
+  Reverse reply payload is the port and a reverse status (1 byte)
+  Reverse connect payload is the port and the id of a conn which server proxy accepted on it
+**/
+const (
+	ControlPing           = 0x1
+	ControlPong           = 0x2
+	ControlDNSQuery       = 0x3
+	ControlDNSAnswer      = 0x4
+	ControlReverseOpen    = 0x5
+	ControlReverseReply   = 0x6
+	ControlReverseConnect = 0x7
+)
+
+/**
+  Reverse statuses, refused means the port is not granted to the user
+**/
+const (
+	ReverseOK      = 0x0
+	ReverseRefused = 0x1
+	ReverseFailed  = 0x2
+)
+
+const controlHeaderLength = 3
+const pingPayloadLength = 12
+
+/**
+  Default heartbeat settings
+  Each side sends a ping every interval seconds
+  The other side is dead after miss count intervals without any frame
+**/
+const DefaultHeartBeatInterval = 5
+const DefaultHeartBeatMissCount = 3
+
+/**
+  Liveness states of the other side
+**/
+const (
+	LivenessAlive   = "alive"
+	LivenessSuspect = "suspect"
+	LivenessDead    = "dead"
+)
+
+/**
+  Control channel wraps control tcp conn
+  Write mutex makes sure frames from different go routines are not mixed
+**/
+type ControlChannel struct {
+	conn       net.Conn
+	table      *Encryption.Table
+	writeMutex sync.Mutex
+}
+
+/**
+  Simple constructor for control channel
+**/
+func NewControlChannel(conn net.Conn, table *Encryption.Table) *ControlChannel {
+	return &ControlChannel{conn: conn, table: table}
+}
+
+/**
+  Simple getter for tcp conn
+**/
+func (c *ControlChannel) GetConn() net.Conn {
+	return c.conn
+}
+
+/**
+  Encode and write one frame
+**/
+func (c *ControlChannel) WriteFrame(frameType byte, payload []byte) error {
+	if len(payload) > 0xffff {
+		return errors.New("control frame is too long")
+	}
+	frame := make([]byte, controlHeaderLength+len(payload))
+	frame[0] = frameType
+	binary.BigEndian.PutUint16(frame[1:3], uint16(len(payload)))
+	copy(frame[controlHeaderLength:], payload)
+	frame = c.table.Encode(frame)
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	_, err := WriteAll(frame, c.conn, len(frame))
+	return err
+}
+
+/**
+  Read and decode one frame, it blocks until deadline of tcp conn
+**/
+func (c *ControlChannel) ReadFrame() (byte, []byte, error) {
+	header := make([]byte, controlHeaderLength)
+	if _, err := ReadAll(header, c.conn, controlHeaderLength); err != nil {
+		return 0, nil, err
+	}
+	header = c.table.Decode(header)
+	length := int(binary.BigEndian.Uint16(header[1:3]))
+	payload := make([]byte, length)
+	if length > 0 {
+		if _, err := ReadAll(payload, c.conn, length); err != nil {
+			return 0, nil, err
+		}
+		payload = c.table.Decode(payload)
+	}
+	return header[0], payload, nil
+}
+
+/**
+  Liveness keeps the state of the other side
+  LastSeen is the time of last frame from the other side
+  Rtt is the last round trip time and smoothed rtt is the moving average
+**/
+type Liveness struct {
+	mutex       sync.Mutex
+	interval    time.Duration
+	missCount   int
+	lastSeen    time.Time
+	nextSeq     uint32
+	rtt         time.Duration
+	smoothedRtt time.Duration
+}
+
+/**
+  Simple constructor for liveness, miss count is at least 2
+**/
+func NewLiveness(interval time.Duration, missCount int) *Liveness {
+	if missCount < 2 {
+		missCount = 2
+	}
+	return &Liveness{interval: interval, missCount: missCount, lastSeen: time.Now()}
+}
+
+/**
+  Simple getter for interval
+**/
+func (l *Liveness) GetInterval() time.Duration {
+	return l.interval
+}
+
+/**
+  Longest time without any frame before the other side is dead
+**/
+func (l *Liveness) GetDeadline() time.Duration {
+	return l.interval * time.Duration(l.missCount)
+}
+
+/**
+  Build payload of next ping
+**/
+func (l *Liveness) NextPing() []byte {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.nextSeq++
+	payload := make([]byte, pingPayloadLength)
+	binary.BigEndian.PutUint32(payload[0:4], l.nextSeq)
+	binary.BigEndian.PutUint64(payload[4:12], uint64(time.Now().UnixNano()))
+	return payload
+}
+
+/**
+  Any frame from the other side means it is alive
+**/
+func (l *Liveness) Seen() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.lastSeen = time.Now()
+}
+
+/**
+  Handle a pong, the sequence number must be one we have sent
+  Round trip time is measured by the send time in payload
+**/
+func (l *Liveness) Pong(payload []byte) error {
+	if len(payload) != pingPayloadLength {
+		return errors.New("invalid pong")
+	}
+	seq := binary.BigEndian.Uint32(payload[0:4])
+	sent := time.Unix(0, int64(binary.BigEndian.Uint64(payload[4:12])))
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if seq == 0 || seq > l.nextSeq {
+		return errors.New("pong has unknown sequence number")
+	}
+	now := time.Now()
+	l.lastSeen = now
+	l.rtt = now.Sub(sent)
+	if l.smoothedRtt == 0 {
+		l.smoothedRtt = l.rtt
+	} else {
+		// same weight as tcp srtt
+		l.smoothedRtt = (7*l.smoothedRtt + l.rtt) / 8
+	}
+	return nil
+}
+
+/**
+  Alive when a frame came within two intervals
+  Dead when there is no frame for miss count intervals
+  Suspect in between
+**/
+func (l *Liveness) GetState() string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	elapsed := time.Since(l.lastSeen)
+	if elapsed < 2*l.interval {
+		return LivenessAlive
+	}
+	if elapsed < l.interval*time.Duration(l.missCount) {
+		return LivenessSuspect
+	}
+	return LivenessDead
+}
+
+/**
+  Simple getter for last and smoothed round trip time
+**/
+func (l *Liveness) GetRtt() (time.Duration, time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.rtt, l.smoothedRtt
+}
+
+/**
+  This function sends a ping every interval until it fails or stop is closed
+  It returns when the other side is dead
+**/
+func SendPings(control *ControlChannel, liveness *Liveness, stop chan struct{}) error {
+	ticker := time.NewTicker(liveness.GetInterval())
+	defer ticker.Stop()
+	for {
+		if liveness.GetState() == LivenessDead {
+			return errors.New("heartbeat timeout")
+		}
+		if err := control.WriteFrame(ControlPing, liveness.NextPing()); err != nil {
+			return err
+		}
+		select {
+		case <-stop:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+/**
+  This function reads frames until an error or the other side is dead
+  Pings are answered with pongs, other frames are given to handle
+**/
+func ReceiveFrames(control *ControlChannel, liveness *Liveness, handle func(byte, []byte) error) error {
+	for {
+		if err := control.GetConn().SetReadDeadline(time.Now().Add(liveness.GetDeadline())); err != nil {
+			return err
+		}
+		frameType, payload, err := control.ReadFrame()
+		if err != nil {
+			if errs, ok := err.(net.Error); ok && errs.Timeout() {
+				return errors.New("heartbeat timeout")
+			}
+			return err
+		}
+		liveness.Seen()
+		switch frameType {
+		case ControlPing:
+			err = control.WriteFrame(ControlPong, payload)
+		case ControlPong:
+			err = liveness.Pong(payload)
+		default:
+			if handle == nil {
+				err = errors.New("unknown control frame")
+			} else {
+				err = handle(frameType, payload)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
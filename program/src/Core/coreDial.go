@@ -0,0 +1,142 @@
+package Core
+
+/**
+  Author: JiaCheng Yang && Wenkai Zheng
+  This file is used for connecting server proxy to a target which has many addresses
+  Addresses are tried by happy eyeballs (RFC 8305): families take turns, a new attempt starts
+  every attempt delay or at once when one fails, and the first conn which is made wins
+  So a broken ipv6 path costs one attempt delay instead of the whole connect timeout
+**/
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+/**
+  Default time between two attempts, it is recommended by RFC 8305
+**/
+const DefaultAttemptDelay = 250 * time.Millisecond
+
+var errNoAddress = errors.New("no address to connect")
+
+/**
+  Result of one attempt
+**/
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+/**
+  Dialer for gives the dialer of an attempt, so the local address or interface can depend on the target
+  Nil dialer for lets the system choose
+**/
+type DialerFor func(addr *net.TCPAddr) net.Dialer
+
+/**
+  This function connects to one of addresses within connect timeout, which covers all attempts
+  Addresses are in preferred order, the family of the first one goes first
+**/
+func DialAddresses(addrs []*net.TCPAddr, timeouts Timeouts, dialerFor DialerFor) (net.Conn, error) {
+	if len(addrs) == 0 {
+		return nil, errNoAddress
+	}
+	addrs = interleave(addrs)
+	delay := timeouts.AttemptDelay
+	if delay <= 0 {
+		delay = DefaultAttemptDelay
+	}
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if timeouts.Connect > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), timeouts.Connect)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	defer cancel()
+	// buffered so attempts which finish late never block
+	results := make(chan dialResult, len(addrs))
+	next, running := 0, 0
+	var attempt <-chan time.Time
+	start := func() {
+		addr := addrs[next]
+		next++
+		running++
+		go func() {
+			var dialer net.Dialer
+			if dialerFor != nil {
+				dialer = dialerFor(addr)
+			}
+			conn, err := dialer.DialContext(ctx, "tcp", addr.String())
+			results <- dialResult{conn: conn, err: err}
+		}()
+		if next < len(addrs) {
+			attempt = time.After(delay)
+		} else {
+			attempt = nil
+		}
+	}
+	start()
+	var lastErr error
+	for running > 0 {
+		select {
+		case result := <-results:
+			running--
+			if result.err == nil {
+				cancel()
+				go closeLate(results, running)
+				return result.conn, nil
+			}
+			lastErr = result.err
+			// a failed attempt does not wait for attempt delay
+			if next < len(addrs) && ctx.Err() == nil {
+				start()
+			}
+		case <-attempt:
+			start()
+		}
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, errors.New("connect timeout, last error: " + lastErr.Error())
+	}
+	return nil, lastErr
+}
+
+/**
+  Attempts which are still running are canceled, but one can make a conn before it sees that
+**/
+func closeLate(results chan dialResult, running int) {
+	for ; running > 0; running-- {
+		if result := <-results; result.conn != nil {
+			_ = result.conn.Close()
+		}
+	}
+}
+
+/**
+  Put addresses of two families in turns, starting with the family of the first address
+  Order in each family is kept
+**/
+func interleave(addrs []*net.TCPAddr) []*net.TCPAddr {
+	var first, second []*net.TCPAddr
+	firstIsV4 := addrs[0].IP.To4() != nil
+	for _, addr := range addrs {
+		if (addr.IP.To4() != nil) == firstIsV4 {
+			first = append(first, addr)
+		} else {
+			second = append(second, addr)
+		}
+	}
+	ordered := make([]*net.TCPAddr, 0, len(addrs))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			ordered = append(ordered, first[i])
+		}
+		if i < len(second) {
+			ordered = append(ordered, second[i])
+		}
+	}
+	return ordered
+}
@@ -6,7 +6,8 @@
 package Core
 
 import (
-	"encoding/binary"
+	"Logging"
+	"context"
 	"errors"
 	"net"
 	"io"
@@ -30,6 +31,17 @@ type Proxy struct {
 	localHost  *net.TCPAddr
 	serverHost *net.TCPAddr
 	device     int // 1 is server 0 is local
+	resolver   Resolver
+}
+
+/**
+   Resolver finds all addresses of a domain name for server proxy, preferred family first
+   Exchange answers a dns query which is tunneled from local proxy
+   Without resolver the system resolver is used
+**/
+type Resolver interface {
+	Lookup(name string) ([]net.IP, error)
+	Exchange(query []byte) ([]byte, error)
 }
 /**
    Concurrent write to a file 
@@ -39,6 +51,25 @@ func (w *SW) Write(b []byte) (n int, err error) {
     defer w.m.Unlock()
     return w.Writer.Write(b)
 }
+/**
+   Flush and close the file, it is safe to call with nil
+**/
+func (w *SW) Close() error {
+	if w == nil {
+		return nil
+	}
+	w.m.Lock()
+	defer w.m.Unlock()
+	if file, ok := w.Writer.(*os.File); ok {
+		if err := file.Sync(); err != nil {
+			return err
+		}
+	}
+	if closer, ok := w.Writer.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
 /**
    Open this file when server proxy is running
 **/
@@ -49,16 +80,27 @@ func OpenFileSW(name string )(*SW){
 	}
 	return &SW{sync.Mutex{},file}
 }
+/**
+   Open this file for appending, old records are kept
+**/
+func AppendFileSW(name string) *SW {
+	file, fileError := os.OpenFile(name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if fileError != nil {
+		return nil
+	}
+	return &SW{sync.Mutex{}, file}
+}
 
 
 /**
    This is the constructor for ServerProxy
    It just have local tcp addr because it hasn't know
    the remote tcp addr yet
+   An empty host listens on all addresses of both ipv4 and ipv6
 **/
 func NewServerProxy(local string) (*Proxy, error) {
 	// as a server we don't need ip address just port
-	addr0, err := net.ResolveTCPAddr("tcp4", local)
+	addr0, err := net.ResolveTCPAddr("tcp", local)
 	if err != nil {
 		return nil, err
 	}
@@ -121,6 +163,20 @@ func (p *Proxy) SetLocalHost(copy *net.TCPAddr) error {
 	return nil
 }
 
+/**
+	Simple setter for resolver
+**/
+func (p *Proxy) SetResolver(resolver Resolver) {
+	p.resolver = resolver
+}
+
+/**
+	Simple getter for resolver, it is nil when system resolver is used
+**/
+func (p *Proxy) GetResolver() Resolver {
+	return p.resolver
+}
+
 /**
     Return this proxy is local or server
 **/
@@ -130,31 +186,54 @@ func (p Proxy) GetDevice() int {
 
 /**
   This function help server proxy to connect to real server
-  The last two bytes is port number
-  First to get ATYP either ipv4, ipv6 or Domain name
-  For ipv4 and ipv6 it starts from 4 to it's length
-  For domain name it starts from 5 until first byte of port
-  (starts from 5 because 4 is used for indicating length)
-**/
-func (p *Proxy) ConnectToRealServer(request []byte, length int, sw *SW) *net.TCPAddr {
-	port := int(binary.BigEndian.Uint16(request[length-2:]))
-	var ip []byte
-	if request[3] == 0x1 {
-		ip = request[4 : 4+net.IPv4len]
-		fmt.Fprintln(sw, string(ip))
-	} else if request[3] == 0x3 {
-		ip1, err := net.ResolveIPAddr("ip", string(request[5:length-2]))
-		fmt.Fprintln(sw, string(request[5:length-2]))
-		fmt.Println("--------------------------------------------------------------")
+  Ip of the target is used as it is and a domain name is resolved
+  A domain name gives all of its addresses, so another one is tried when one does not work
+**/
+func (p *Proxy) ConnectToRealServer(target *SocksAddr, sw *SW) []*net.TCPAddr {
+	fmt.Fprintln(sw, target.GetHost())
+	addrs, err := p.ResolveTCPAddrs(target)
+	if err != nil {
+		Logging.ErrorLogger.Println("could not resolve", target.Name, err)
+		return nil
+	}
+	return addrs
+}
+
+/**
+  Addresses of a target, the first proxy of a chain is resolved by it as well
+**/
+func (p *Proxy) ResolveTCPAddrs(target *SocksAddr) ([]*net.TCPAddr, error) {
+	ips := []net.IP{target.IP}
+	if target.Type == DomainName {
+		resolved, err := p.lookupIPs(target.Name)
 		if err != nil {
-			return nil
+			return nil, err
 		}
-		ip = ip1.IP
-	} else if request[3] == 0x4 {
-		ip = request[4 : 4+net.IPv6len]
-		fmt.Fprintln(sw, string(ip))
-	}
-	return &net.TCPAddr{
-		IP:   ip,
-		Port: port}
+		ips = resolved
+	}
+	addrs := make([]*net.TCPAddr, 0, len(ips))
+	for _, ip := range ips {
+		addrs = append(addrs, &net.TCPAddr{
+			IP:   ip,
+			Port: target.Port})
+	}
+	return addrs, nil
+}
+
+/**
+  Resolve a domain name by resolver of proxy or by system resolver
+**/
+func (p *Proxy) lookupIPs(name string) ([]net.IP, error) {
+	if p.resolver != nil {
+		return p.resolver.Lookup(name)
+	}
+	ipAddrs, err := net.DefaultResolver.LookupIPAddr(context.Background(), name)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, 0, len(ipAddrs))
+	for _, ipAddr := range ipAddrs {
+		ips = append(ips, ipAddr.IP)
+	}
+	return ips, nil
 }
@@ -0,0 +1,171 @@
+package Core
+
+/**
+  Author: JiaCheng Yang && Wenkai Zheng
+  This file is used for the address of a socks5 request or reply
+  Both proxies read and write addresses only by socks addr, so ipv4, ipv6 and domain names are handled the same way
+**/
+import (
+	"Encryption"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+)
+
+/**
+	+------+----------+----------+
+	| ATYP | DST.ADDR | DST.PORT |
+	+------+----------+----------+
+	|  1   | Variable |    2     |
+	+------+----------+----------+
+  Address is 4 bytes for ipv4, 16 bytes for ipv6
+  and one byte of length followed by the name for domain name
+**/
+var errAddressType = errors.New("unknown address type")
+
+/**
+  Socks addr keeps ip for ipv4 and ipv6 and name for domain name
+**/
+type SocksAddr struct {
+	Type byte
+	IP   net.IP
+	Name string
+	Port int
+}
+
+/**
+  This function makes a socks addr from host:port, an ip host is never sent as a name
+**/
+func NewSocksAddr(address string) (*SocksAddr, error) {
+	host, portText, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portText)
+	if err != nil || port < 0 || port > 0xffff {
+		return nil, errors.New("wrong port in " + address)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			return &SocksAddr{Type: IpV4, IP: ip4, Port: port}, nil
+		}
+		return &SocksAddr{Type: IpV6, IP: ip, Port: port}, nil
+	}
+	if host == "" || len(host) > 255 {
+		return nil, errors.New("wrong domain name in " + address)
+	}
+	return &SocksAddr{Type: DomainName, Name: host, Port: port}, nil
+}
+
+/**
+  This function reads ATYP, address and port from a conn
+  Bytes are decoded by table, nil table means they are not encoded
+**/
+func ReadSocksAddr(conn net.Conn, table *Encryption.Table) (*SocksAddr, error) {
+	read := func(size int) ([]byte, error) {
+		buffer := make([]byte, size)
+		if _, err := ReadAll(buffer, conn, size); err != nil {
+			return nil, err
+		}
+		if table != nil {
+			table.DecodeInPlace(buffer)
+		}
+		return buffer, nil
+	}
+	header, err := read(1)
+	if err != nil {
+		return nil, err
+	}
+	var rest []byte
+	switch header[0] {
+	case IpV4:
+		rest, err = read(net.IPv4len + 2)
+	case IpV6:
+		rest, err = read(net.IPv6len + 2)
+	case DomainName:
+		var length []byte
+		if length, err = read(1); err != nil {
+			return nil, err
+		}
+		header = append(header, length[0])
+		rest, err = read(int(length[0]) + 2)
+	default:
+		return nil, errAddressType
+	}
+	if err != nil {
+		return nil, err
+	}
+	addr, _, err := ParseSocksAddr(append(header, rest...))
+	return addr, err
+}
+
+/**
+  This function parses a socks addr at the start of data
+  It returns the addr and the number of bytes it takes
+**/
+func ParseSocksAddr(data []byte) (*SocksAddr, int, error) {
+	if len(data) < 1 {
+		return nil, 0, errAddressType
+	}
+	addr := &SocksAddr{Type: data[0]}
+	var length int
+	switch addr.Type {
+	case IpV4, IpV6:
+		size := net.IPv4len
+		if addr.Type == IpV6 {
+			size = net.IPv6len
+		}
+		length = 1 + size + 2
+		if len(data) < length {
+			return nil, 0, errors.New("socks address is too short")
+		}
+		addr.IP = net.IP(append([]byte(nil), data[1:1+size]...))
+	case DomainName:
+		if len(data) < 2 {
+			return nil, 0, errors.New("socks address is too short")
+		}
+		length = 2 + int(data[1]) + 2
+		if len(data) < length || data[1] == 0 {
+			return nil, 0, errors.New("socks address is too short")
+		}
+		addr.Name = string(data[2 : 2+int(data[1])])
+	default:
+		return nil, 0, errAddressType
+	}
+	addr.Port = int(binary.BigEndian.Uint16(data[length-2:]))
+	return addr, length, nil
+}
+
+/**
+  Serialize ATYP, address and port
+**/
+func (a *SocksAddr) Bytes() []byte {
+	var data []byte
+	switch a.Type {
+	case IpV4:
+		data = append([]byte{IpV4}, a.IP.To4()...)
+	case IpV6:
+		data = append([]byte{IpV6}, a.IP.To16()...)
+	default:
+		data = append([]byte{DomainName, byte(len(a.Name))}, a.Name...)
+	}
+	return append(data, byte(a.Port>>8), byte(a.Port))
+}
+
+/**
+  Simple getter for host, it is the ip or the domain name
+**/
+func (a *SocksAddr) GetHost() string {
+	if a.Type == DomainName {
+		return a.Name
+	}
+	return a.IP.String()
+}
+
+/**
+  Host and port, ipv6 is in brackets
+**/
+func (a *SocksAddr) String() string {
+	return net.JoinHostPort(a.GetHost(), strconv.Itoa(a.Port))
+}
@@ -0,0 +1,148 @@
+package Core
+
+/**
+  Author: JiaCheng Yang && Wenkai Zheng
+  Table tests of socks addr, bytes of each address type are parsed, read from a conn and written back
+**/
+import (
+	"Encryption"
+	"bytes"
+	"net"
+	"testing"
+)
+
+var socksAddrCases = []struct {
+	name    string
+	data    []byte
+	address string
+	addr    SocksAddr
+}{
+	{
+		name:    "ipv4",
+		data:    []byte{IpV4, 192, 168, 1, 20, 0x1F, 0x90},
+		address: "192.168.1.20:8080",
+		addr:    SocksAddr{Type: IpV4, IP: net.IPv4(192, 168, 1, 20).To4(), Port: 8080},
+	},
+	{
+		name:    "ipv4 low port",
+		data:    []byte{IpV4, 10, 0, 0, 1, 0x00, 0x50},
+		address: "10.0.0.1:80",
+		addr:    SocksAddr{Type: IpV4, IP: net.IPv4(10, 0, 0, 1).To4(), Port: 80},
+	},
+	{
+		name:    "domain",
+		data:    append(append([]byte{DomainName, 11}, "example.com"...), 0x01, 0xBB),
+		address: "example.com:443",
+		addr:    SocksAddr{Type: DomainName, Name: "example.com", Port: 443},
+	},
+	{
+		name:    "ipv6 port above 255",
+		data:    []byte{IpV6, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x01, 0xC3, 0x50},
+		address: "[2001:db8::1]:50000",
+		addr:    SocksAddr{Type: IpV6, IP: net.ParseIP("2001:db8::1"), Port: 50000},
+	},
+	{
+		name:    "ipv6 loopback",
+		data:    []byte{IpV6, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x01, 0x00},
+		address: "[::1]:256",
+		addr:    SocksAddr{Type: IpV6, IP: net.IPv6loopback, Port: 256},
+	},
+}
+
+func equalSocksAddr(a, b *SocksAddr) bool {
+	return a.Type == b.Type && a.IP.Equal(b.IP) && a.Name == b.Name && a.Port == b.Port
+}
+
+/**
+  Bytes are parsed to the addr and the addr gives the same bytes, trailing data is not taken
+**/
+func TestParseSocksAddr(t *testing.T) {
+	for _, item := range socksAddrCases {
+		addr, length, err := ParseSocksAddr(append(append([]byte(nil), item.data...), 0xEE, 0xEE))
+		if err != nil {
+			t.Fatalf("%s: %v", item.name, err)
+		}
+		if length != len(item.data) {
+			t.Fatalf("%s: took %d bytes, want %d", item.name, length, len(item.data))
+		}
+		if !equalSocksAddr(addr, &item.addr) {
+			t.Fatalf("%s: got %+v, want %+v", item.name, addr, item.addr)
+		}
+		if !bytes.Equal(addr.Bytes(), item.data) {
+			t.Fatalf("%s: bytes are %v, want %v", item.name, addr.Bytes(), item.data)
+		}
+		if addr.String() != item.address {
+			t.Fatalf("%s: string is %s, want %s", item.name, addr, item.address)
+		}
+		parsed, err := NewSocksAddr(item.address)
+		if err != nil {
+			t.Fatalf("%s: %v", item.name, err)
+		}
+		if !equalSocksAddr(parsed, &item.addr) || !bytes.Equal(parsed.Bytes(), item.data) {
+			t.Fatalf("%s: %s is parsed to %+v", item.name, item.address, parsed)
+		}
+	}
+}
+
+/**
+  Addresses are read from a conn, plain and encoded by a table
+**/
+func TestReadSocksAddr(t *testing.T) {
+	table := Encryption.NewEncryptionTable()
+	for _, encoded := range []bool{false, true} {
+		for _, item := range socksAddrCases {
+			client, server := net.Pipe()
+			data := item.data
+			var decoder *Encryption.Table
+			if encoded {
+				data, decoder = table.Encode(item.data), table
+			}
+			go func() {
+				_, _ = client.Write(data)
+				_ = client.Close()
+			}()
+			addr, err := ReadSocksAddr(server, decoder)
+			_ = server.Close()
+			if err != nil {
+				t.Fatalf("%s (encoded %v): %v", item.name, encoded, err)
+			}
+			if !equalSocksAddr(addr, &item.addr) {
+				t.Fatalf("%s (encoded %v): got %+v, want %+v", item.name, encoded, addr, item.addr)
+			}
+		}
+	}
+}
+
+/**
+  Truncated bytes, an empty domain name and an unknown type are refused
+**/
+func TestParseSocksAddrRejects(t *testing.T) {
+	var bad = map[string][]byte{
+		"empty":            {},
+		"ipv4 no port":     {IpV4, 127, 0, 0, 1},
+		"ipv4 half port":   {IpV4, 127, 0, 0, 1, 0x00},
+		"ipv6 short":       {IpV6, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x01},
+		"domain no length": {DomainName},
+		"domain short":     append([]byte{DomainName, 11}, "example"...),
+		"domain no port":   append([]byte{DomainName, 11}, "example.com"...),
+		"empty domain":     {DomainName, 0, 0x00, 0x50},
+		"unknown type":     {0x02, 127, 0, 0, 1, 0x00, 0x50},
+	}
+	for name, data := range bad {
+		if addr, _, err := ParseSocksAddr(data); err == nil {
+			t.Fatalf("%s: parsed to %+v", name, addr)
+		}
+		client, server := net.Pipe()
+		go func(data []byte) {
+			_, _ = client.Write(data)
+			_ = client.Close()
+		}(data)
+		if addr, err := ReadSocksAddr(server, nil); err == nil {
+			t.Fatalf("%s: read %+v", name, addr)
+		}
+		_ = server.Close()
+	}
+	if _, _, err := ParseSocksAddr([]byte{0x02, 127, 0, 0, 1, 0x00, 0x50}); err != errAddressType {
+		t.Fatalf("unknown type: got %v, want %v", err, errAddressType)
+	}
+}
@@ -0,0 +1,190 @@
+package Core
+
+/**
+  Author: JiaCheng Yang && Wenkai Zheng
+  This file is used for timeouts of proxied connections
+  Connect timeout covers dialing, handshake timeout covers socks5 negotiation
+  Idle timeout closes a connection without data in both directions
+  Lifetime closes a connection after a fixed time whatever it is doing
+**/
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+/**
+  Default timeouts in seconds, lifetime 0 means unlimited
+**/
+const DefaultConnectTimeout = 10
+const DefaultHandshakeTimeout = 10
+const DefaultIdleTimeout = 300
+const DefaultLifetime = 0
+
+/**
+  Reasons recorded when a connection is closed
+**/
+const (
+	CloseFinished = "finished"
+	CloseIdle     = "idle timeout"
+	CloseLifetime = "lifetime exceeded"
+	CloseAborted  = "aborted"
+	CloseKilled   = "killed by admin"
+	CloseSession  = "session closed"
+	CloseShutdown = "shutdown"
+)
+
+var errIdleTimeout = errors.New(CloseIdle)
+
+/**
+  All timeouts of a proxy, zero means no timeout
+  Attempt delay is the time between attempts to addresses of one target, zero means default
+**/
+type Timeouts struct {
+	Connect      time.Duration
+	Handshake    time.Duration
+	Idle         time.Duration
+	Lifetime     time.Duration
+	AttemptDelay time.Duration
+}
+
+/**
+  Simple constructor for timeouts, all arguments are in seconds
+  Zero or negative values mean no timeout
+**/
+func NewTimeouts(connect, handshake, idle, lifetime int) Timeouts {
+	return Timeouts{
+		Connect:   seconds(connect),
+		Handshake: seconds(handshake),
+		Idle:      seconds(idle),
+		Lifetime:  seconds(lifetime),
+	}
+}
+
+func seconds(value int) time.Duration {
+	if value < 0 {
+		return 0
+	}
+	return time.Duration(value) * time.Second
+}
+
+/**
+  This function dials a tcp conn within connect timeout
+**/
+func DialTCP(address string, timeout time.Duration) (net.Conn, error) {
+	d := net.Dialer{Timeout: timeout}
+	return d.Dial("tcp", address)
+}
+
+/**
+  This function sets deadline of a tcp conn for handshake
+  Zero timeout clears the deadline
+**/
+func SetHandshakeDeadline(conn net.Conn, timeout time.Duration) error {
+	if timeout == 0 {
+		return conn.SetDeadline(time.Time{})
+	}
+	return conn.SetDeadline(time.Now().Add(timeout))
+}
+
+/**
+  Activity is shared by both directions of a connection
+  Last is the time of last read or write in nanoseconds
+  A direction only times out when the whole connection is idle
+  So a long download is not closed because nothing is uploaded
+**/
+type activity struct {
+	timeout time.Duration
+	last    int64
+}
+
+func newActivity(timeout time.Duration) *activity {
+	return &activity{timeout: timeout, last: time.Now().UnixNano()}
+}
+
+/**
+  Record that data went through
+**/
+func (a *activity) touch() {
+	if a != nil {
+		atomic.StoreInt64(&a.last, time.Now().UnixNano())
+	}
+}
+
+/**
+  Set read deadline before each read
+**/
+func (a *activity) beforeRead(conn net.Conn) error {
+	if a == nil || a.timeout == 0 {
+		return nil
+	}
+	return conn.SetReadDeadline(time.Now().Add(a.timeout))
+}
+
+/**
+  Set write deadline before each write, a peer which does not read is idle too
+**/
+func (a *activity) beforeWrite(conn net.Conn) error {
+	if a == nil || a.timeout == 0 {
+		return nil
+	}
+	return conn.SetWriteDeadline(time.Now().Add(a.timeout))
+}
+
+/**
+  It tells what to do with an error of read
+  Timeout while the other direction is still active is ignored
+  Timeout while both directions are idle becomes errIdleTimeout
+**/
+func (a *activity) check(err error) (bool, error) {
+	errs, ok := err.(net.Error)
+	if a == nil || !ok || !errs.Timeout() {
+		return false, err
+	}
+	if time.Since(time.Unix(0, atomic.LoadInt64(&a.last))) < a.timeout {
+		return true, nil
+	}
+	return false, errIdleTimeout
+}
+
+/**
+  Read exactly len(buffer) bytes, timeouts caused by the other direction are retried
+  Bytes which are already read are kept
+**/
+func (a *activity) readFull(conn net.Conn, buffer []byte) error {
+	readLength := 0
+	for readLength < len(buffer) {
+		if err := a.beforeRead(conn); err != nil {
+			return err
+		}
+		n, err := conn.Read(buffer[readLength:])
+		readLength += n
+		if n > 0 {
+			a.touch()
+		}
+		if err != nil {
+			if retry, errs := a.check(err); !retry {
+				return errs
+			}
+		}
+	}
+	return nil
+}
+
+/**
+  Write all bytes, a write which blocks for timeout is idle
+**/
+func (a *activity) writeFull(conn net.Conn, buffer []byte) error {
+	if err := a.beforeWrite(conn); err != nil {
+		return err
+	}
+	if _, err := WriteAll(buffer, conn, len(buffer)); err != nil {
+		if errs, ok := err.(net.Error); ok && errs.Timeout() {
+			return errIdleTimeout
+		}
+		return err
+	}
+	a.touch()
+	return nil
+}
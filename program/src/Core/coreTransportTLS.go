@@ -0,0 +1,243 @@
+package Core
+
+/**
+  Author: JiaCheng Yang && Wenkai Zheng
+  This file is used for tls transport between local proxy and server proxy
+  Server proxy uses certificate and key files, a self signed certificate is made and saved there when they do not exist
+  Local proxy verifies server certificate by a ca bundle or by a sha256 pin of its public key
+  Without both of them it does not dial, unless insecure is set and tls is only used so that the tunnel looks like https
+  Server name is sent in client hello, so it should be a name which is normal for the server address
+**/
+import (
+	"Logging"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+var errPinMismatch = errors.New("server certificate does not match tls pin")
+
+/**
+  Local proxy never sends the sign in to a server which it can not verify, unless insecure is set
+**/
+var ErrTLSNotVerified = errors.New("tls transport needs tls_ca or tls_pin, or tls_insecure to skip verification")
+
+var errNoCertificate = errors.New("tls transport has no certificate and key")
+
+/**
+  Server tls is nil for local proxy, client error is set when local proxy can not verify server proxy
+**/
+type tlsTransport struct {
+	host      string
+	proxy     string
+	clientTLS *tls.Config
+	clientErr error
+	serverTLS *tls.Config
+}
+
+/**
+  Simple constructor for tls transport
+  Certificate, key and ca bundle are loaded here, so a wrong file is found at start
+**/
+func newTLSTransport(config TransportConfig) (*tlsTransport, error) {
+	t := &tlsTransport{host: config.Host, proxy: config.Proxy}
+	if config.CertFile != "" || config.KeyFile != "" {
+		certificate, err := loadCertificate(config.CertFile, config.KeyFile, config.Host)
+		if err != nil {
+			return nil, err
+		}
+		t.useCertificate(certificate)
+	}
+	clientTLS, err := newClientTLS(config)
+	if err != nil {
+		return nil, err
+	}
+	t.clientTLS = clientTLS
+	if config.CAFile == "" && config.Pin == "" && !config.Insecure {
+		t.clientErr = ErrTLSNotVerified
+	}
+	return t, nil
+}
+
+/**
+  Load certificate and key, when neither file exists a self signed certificate is made and saved
+  So the pin of a self signed certificate stays the same after restarts
+**/
+func loadCertificate(certFile, keyFile, host string) (tls.Certificate, error) {
+	if certFile == "" || keyFile == "" {
+		return tls.Certificate{}, errors.New("tls_cert and tls_key must be set together")
+	}
+	_, certErr := os.Stat(certFile)
+	_, keyErr := os.Stat(keyFile)
+	if !os.IsNotExist(certErr) || !os.IsNotExist(keyErr) {
+		return tls.LoadX509KeyPair(certFile, keyFile)
+	}
+	certificate, err := selfSignedCertificate(host)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyDer, err := x509.MarshalPKCS8PrivateKey(certificate.PrivateKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	// key is written first and only readable by owner, a certificate without key is never left
+	if err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		return tls.Certificate{}, err
+	}
+	if err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate.Certificate[0]}), 0644); err != nil {
+		_ = os.Remove(keyFile)
+		return tls.Certificate{}, err
+	}
+	Logging.NormalLogger.Println("self signed tls certificate is saved in", certFile, "and", keyFile)
+	return certificate, nil
+}
+
+/**
+  Tls config of local proxy
+  Ca bundle verifies the chain and host name, pin verifies the public key of server certificate
+  When both are set both must pass
+**/
+func newClientTLS(config TransportConfig) (*tls.Config, error) {
+	clientTLS := &tls.Config{ServerName: config.Host}
+	if config.CAFile != "" {
+		content, err := ioutil.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(content) {
+			return nil, errors.New("no certificate in " + config.CAFile)
+		}
+		clientTLS.RootCAs = pool
+	}
+	if config.Pin != "" {
+		pin, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(config.Pin, "sha256/"))
+		if err != nil || len(pin) != sha256.Size {
+			return nil, errors.New("tls pin must be sha256/ and base64 of 32 bytes")
+		}
+		clientTLS.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errPinMismatch
+			}
+			leaf, err := x509.ParseCertificate(rawCerts[0])
+			if err != nil {
+				return err
+			}
+			sum := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+			if subtle.ConstantTimeCompare(sum[:], pin) != 1 {
+				return errPinMismatch
+			}
+			return nil
+		}
+	}
+	// chain is only verified with a ca bundle, a pin alone accepts self signed certificate
+	clientTLS.InsecureSkipVerify = config.CAFile == ""
+	return clientTLS, nil
+}
+
+/**
+  Pin of a certificate is sha256 of its public key in base64, like sha256/AbC...=
+**/
+func CertificatePin(certificate *x509.Certificate) string {
+	sum := sha256.Sum256(certificate.RawSubjectPublicKeyInfo)
+	return "sha256/" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+/**
+  Server tls config with one certificate, its pin is logged so it can be put into config of local proxy
+**/
+func (t *tlsTransport) useCertificate(certificate tls.Certificate) {
+	if leaf, err := x509.ParseCertificate(certificate.Certificate[0]); err == nil {
+		Logging.NormalLogger.Println("tls certificate pin is", CertificatePin(leaf))
+	}
+	t.serverTLS = &tls.Config{Certificates: []tls.Certificate{certificate}}
+}
+
+func (t *tlsTransport) GetName() string {
+	return TransportTLS
+}
+
+/**
+  Connect and finish tls handshake within handshake timeout
+  A server which fails verification is closed before sign in, so it never gets the proof
+**/
+func (t *tlsTransport) Dial(address string, timeouts Timeouts) (net.Conn, error) {
+	if t.clientErr != nil {
+		return nil, t.clientErr
+	}
+	conn, err := dialServer(address, t.proxy, timeouts)
+	if err != nil {
+		return nil, err
+	}
+	clientTLS := t.clientTLS.Clone()
+	clientTLS.ServerName = hostOf(t.host, address)
+	tlsConn := tls.Client(conn, clientTLS)
+	if err = tlsConn.Handshake(); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+/**
+  Finish tls handshake, a client which does not speak tls gives its bytes to fallback
+**/
+func (t *tlsTransport) Accept(conn net.Conn) (net.Conn, []byte, error) {
+	if t.serverTLS == nil {
+		return nil, nil, errNoCertificate
+	}
+	recorder := &recordConn{Conn: conn, recording: true}
+	tlsConn := tls.Server(recorder, t.serverTLS)
+	err := tlsConn.Handshake()
+	recorder.recording = false
+	if err != nil {
+		return nil, recorder.received, err
+	}
+	return tlsConn, nil, nil
+}
+
+/**
+  Make an ecdsa certificate for host which is valid for ten years
+  A pin checks only the public key, so the date matters only to a ca bundle
+**/
+func selfSignedCertificate(host string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	if host == "" {
+		host = "localhost"
+	}
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(10, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
@@ -0,0 +1,87 @@
+package Core
+
+/**
+  Author: JiaCheng Yang && Wenkai Zheng
+  Tests of tls transport, a saved self signed certificate keeps its pin and local proxy only dials a server which it can verify
+**/
+import (
+	"crypto/x509"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestTLS(t *testing.T, config TransportConfig) *tlsTransport {
+	config.Name = TransportTLS
+	transport, err := newTLSTransport(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return transport
+}
+
+func serverPin(t *testing.T, transport *tlsTransport) string {
+	leaf, err := x509.ParseCertificate(transport.serverTLS.Certificates[0].Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return CertificatePin(leaf)
+}
+
+/**
+  Accept tls conns of transport and echo them
+**/
+func tlsEchoServer(t *testing.T, transport *tlsTransport) string {
+	return standIn(t, func(conn net.Conn) {
+		defer conn.Close()
+		tlsConn, _, err := transport.Accept(conn)
+		if err != nil {
+			return
+		}
+		_, _ = io.Copy(tlsConn, tlsConn)
+	})
+}
+
+/**
+  Certificate made on first start is loaded on the next start, so its pin does not change
+**/
+func TestTLSCertificateIsSaved(t *testing.T) {
+	directory := t.TempDir()
+	config := TransportConfig{Host: "localhost", CertFile: filepath.Join(directory, "cert.pem"), KeyFile: filepath.Join(directory, "key.pem")}
+	first := serverPin(t, newTestTLS(t, config))
+	if second := serverPin(t, newTestTLS(t, config)); second != first {
+		t.Fatalf("pin changed from %s to %s", first, second)
+	}
+	config.KeyFile = filepath.Join(directory, "other.pem")
+	if _, err := newTLSTransport(config); err == nil {
+		t.Fatal("certificate was loaded without its key")
+	}
+}
+
+/**
+  Local proxy dials with a pin or insecure, without them and with a wrong pin it does not
+**/
+func TestTLSDialVerifiesServer(t *testing.T) {
+	directory := t.TempDir()
+	server := newTestTLS(t, TransportConfig{Host: "localhost", CertFile: filepath.Join(directory, "cert.pem"), KeyFile: filepath.Join(directory, "key.pem")})
+	address := tlsEchoServer(t, server)
+	timeouts := Timeouts{Connect: 5 * time.Second, Handshake: 5 * time.Second}
+
+	for _, config := range []TransportConfig{{Host: "localhost", Pin: serverPin(t, server)}, {Host: "localhost", Insecure: true}} {
+		conn, err := newTestTLS(t, config).Dial(address, timeouts)
+		if err != nil {
+			t.Fatalf("%+v: %v", config, err)
+		}
+		checkEcho(t, conn)
+	}
+	if _, err := newTestTLS(t, TransportConfig{Host: "localhost"}).Dial(address, timeouts); err != ErrTLSNotVerified {
+		t.Fatalf("without ca and pin: got %v, want %v", err, ErrTLSNotVerified)
+	}
+	wrongPin := TransportConfig{Host: "localhost", Pin: "sha256/AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="}
+	if conn, err := newTestTLS(t, wrongPin).Dial(address, timeouts); err == nil {
+		_ = conn.Close()
+		t.Fatal("dialed a server with another pin")
+	}
+}
@@ -0,0 +1,301 @@
+package Core
+
+/**
+  Author: JiaCheng Yang && Wenkai Zheng
+  This file is used for websocket transport between local proxy and server proxy
+  After the upgrade every write is one binary websocket frame, so http proxies and firewalls which read websocket are fine
+  Frames of local proxy are masked as RFC 6455 asks for frames of clients
+**/
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+/**
+	+-----+-----+--------+------+---------+----------+---------+
+	| FIN | RSV | OPCODE | MASK | LENGTH  | MASK KEY | PAYLOAD |
+	+-----+-----+--------+------+---------+----------+---------+
+	|  1  |  3  |   4    |  1   | 7+16/64 | 0 or 32  | LENGTH  |
+	+-----+-----+--------+------+---------+----------+---------+
+  Sizes are in bits, length 126 means 16 more bits of length and 127 means 64 more bits
+**/
+const (
+	websocketContinuation = 0x0
+	websocketBinary       = 0x2
+	websocketClose        = 0x8
+	websocketPing         = 0x9
+	websocketPong         = 0xA
+)
+
+const websocketFin = 0x80
+const websocketMask = 0x80
+const maxControlPayload = 125
+
+var errWebSocketFrame = errors.New("wrong websocket frame")
+var errWriteClosed = errors.New("websocket conn is closed for writing")
+
+/**
+  Websocket transport, its handshake is the same as http transport
+**/
+type webSocketTransport struct {
+	path  string
+	host  string
+	proxy string
+}
+
+/**
+  Simple constructor for websocket transport
+**/
+func newWebSocketTransport(config TransportConfig) *webSocketTransport {
+	path := config.Path
+	if path == "" {
+		path = "/"
+	}
+	return &webSocketTransport{path: path, host: config.Host, proxy: config.Proxy}
+}
+
+func (t *webSocketTransport) GetName() string {
+	return TransportWebSocket
+}
+
+/**
+  Connect, directly or by upstream http proxy, and upgrade to websocket
+**/
+func (t *webSocketTransport) Dial(address string, timeouts Timeouts) (net.Conn, error) {
+	conn, err := dialServer(address, t.proxy, timeouts)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := clientUpgrade(conn, t.path, hostOf(t.host, address))
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return newWebSocketConn(conn, reader, true), nil
+}
+
+/**
+  Read an upgrade request, anything else is not from local proxy
+**/
+func (t *webSocketTransport) Accept(conn net.Conn) (net.Conn, []byte, error) {
+	recorder := &recordConn{Conn: conn, recording: true}
+	reader, err := serverUpgrade(recorder, t.path)
+	recorder.recording = false
+	if err != nil {
+		return nil, recorder.received, err
+	}
+	return newWebSocketConn(recorder, reader, false), nil, nil
+}
+
+/**
+  Websocket conn reads payload of data frames and answers control frames
+  Remaining is the payload which is not read yet in current frame
+  Write mutex makes sure pongs from reading are not mixed with data frames
+  A close frame is a half close: the side which sends it does not write anymore, but it still reads
+  until the close frame of the other side, which is sent when that side closes or half closes as well
+  Both sides of the tunnel are our proxies, so a close frame is not answered at once as browsers do
+**/
+type webSocketConn struct {
+	net.Conn
+	reader      *bufio.Reader
+	client      bool
+	remaining   uint64
+	masked      bool
+	mask        [4]byte
+	maskIndex   int
+	readClosed  bool
+	writeClosed bool
+	writeMutex  sync.Mutex
+	closeOnce   sync.Once
+}
+
+/**
+  Simple constructor for websocket conn
+**/
+func newWebSocketConn(conn net.Conn, reader *bufio.Reader, client bool) *webSocketConn {
+	return &webSocketConn{Conn: conn, reader: reader, client: client}
+}
+
+/**
+  Read payload of data frames, a close frame is EOF
+**/
+func (c *webSocketConn) Read(buffer []byte) (int, error) {
+	if c.readClosed {
+		return 0, io.EOF
+	}
+	for c.remaining == 0 {
+		if err := c.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+	if uint64(len(buffer)) > c.remaining {
+		buffer = buffer[:c.remaining]
+	}
+	readLength, err := c.reader.Read(buffer)
+	if c.masked {
+		for i := 0; i < readLength; i++ {
+			buffer[i] ^= c.mask[c.maskIndex&3]
+			c.maskIndex++
+		}
+	}
+	c.remaining -= uint64(readLength)
+	return readLength, err
+}
+
+/**
+  Read a frame header, control frames are handled here
+  It returns when a data frame with payload is found
+**/
+func (c *webSocketConn) nextFrame() error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(c.reader, header); err != nil {
+		return err
+	}
+	opcode := header[0] & 0xF
+	c.masked = header[1]&websocketMask != 0
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		extended := make([]byte, 2)
+		if _, err := io.ReadFull(c.reader, extended); err != nil {
+			return err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended))
+	case 127:
+		extended := make([]byte, 8)
+		if _, err := io.ReadFull(c.reader, extended); err != nil {
+			return err
+		}
+		length = binary.BigEndian.Uint64(extended)
+	}
+	// frames of client must be masked and frames of server must not
+	if c.masked == c.client {
+		return errWebSocketFrame
+	}
+	if c.masked {
+		if _, err := io.ReadFull(c.reader, c.mask[:]); err != nil {
+			return err
+		}
+	}
+	c.maskIndex = 0
+	switch opcode {
+	case websocketContinuation, websocketBinary:
+		c.remaining = length
+		return nil
+	case websocketClose, websocketPing, websocketPong:
+		if length > maxControlPayload {
+			return errWebSocketFrame
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.reader, payload); err != nil {
+			return err
+		}
+		if c.masked {
+			for i := range payload {
+				payload[i] ^= c.mask[i&3]
+			}
+		}
+		// a side which has half closed does not answer pings anymore
+		if opcode == websocketPing {
+			if err := c.writeFrame(websocketPong, payload); err != errWriteClosed {
+				return err
+			}
+		}
+		if opcode == websocketClose {
+			c.readClosed = true
+			return io.EOF
+		}
+		return nil
+	}
+	return errWebSocketFrame
+}
+
+/**
+  Each write is one binary frame
+**/
+func (c *webSocketConn) Write(buffer []byte) (int, error) {
+	if err := c.writeFrame(websocketBinary, buffer); err != nil {
+		return 0, err
+	}
+	return len(buffer), nil
+}
+
+/**
+  Make header, mask payload of client and write them at once
+**/
+func (c *webSocketConn) writeFrame(opcode byte, payload []byte) error {
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, websocketFin|opcode)
+	var maskBit byte
+	if c.client {
+		maskBit = websocketMask
+	}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, maskBit|byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		frame = append(frame, maskBit|126, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(len(payload)))
+	default:
+		frame = append(frame, maskBit|127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[2:], uint64(len(payload)))
+	}
+	if c.client {
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return err
+		}
+		frame = append(frame, mask[:]...)
+		start := len(frame)
+		frame = append(frame, payload...)
+		for i := range frame[start:] {
+			frame[start+i] ^= mask[i&3]
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	if c.writeClosed {
+		return errWriteClosed
+	}
+	if opcode == websocketClose {
+		c.writeClosed = true
+	}
+	_, err := WriteAll(frame, c.Conn, len(frame))
+	return err
+}
+
+/**
+  Close frame is sent once
+**/
+func (c *webSocketConn) sendClose() error {
+	var err error
+	c.closeOnce.Do(func() {
+		err = c.writeFrame(websocketClose, nil)
+	})
+	return err
+}
+
+/**
+  Half close by a close frame, the other side reads EOF and can still write
+**/
+func (c *webSocketConn) CloseWrite() error {
+	return c.sendClose()
+}
+
+/**
+  Send close frame before closing tcp conn, errors of it are ignored because the conn is closing anyway
+  The deadline stops a write which is blocked by a peer which does not read
+**/
+func (c *webSocketConn) Close() error {
+	_ = c.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+	_ = c.sendClose()
+	return c.Conn.Close()
+}
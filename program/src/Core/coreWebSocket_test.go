@@ -0,0 +1,172 @@
+package Core
+
+/**
+  Author: JiaCheng Yang && Wenkai Zheng
+  Tests of websocket transport, local side is webSocketTransport.Dial and server side is webSocketTransport.Accept on a real listener
+  Dial goes directly and through an upstream http proxy, which is an httptest server that only knows CONNECT
+**/
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+/**
+  Server proxy side, each accepted conn reads until the close frame of local proxy and then writes the echo
+  So a close frame is a half close and the echo arrives before EOF
+**/
+func webSocketEchoServer(t *testing.T, transport *webSocketTransport) string {
+	return standIn(t, func(conn net.Conn) {
+		defer conn.Close()
+		webSocketConn, _, err := transport.Accept(conn)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		received, err := io.ReadAll(webSocketConn)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if _, err = webSocketConn.Write(received); err != nil {
+			t.Error(err)
+		}
+		_ = webSocketConn.Close()
+	})
+}
+
+/**
+  Upstream http proxy in an httptest server, CONNECT is hijacked and piped to the target
+  User name and password are asked when user is not empty, tunnels counts CONNECTs which are piped
+**/
+func connectProxy(t *testing.T, user, password string) (*httptest.Server, *int32) {
+	var tunnels int32
+	credential := "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "only CONNECT", http.StatusMethodNotAllowed)
+			return
+		}
+		if user != "" && r.Header.Get("Proxy-Authorization") != credential {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		conn, buffered, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		if _, err = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+			_ = conn.Close()
+			return
+		}
+		atomic.AddInt32(&tunnels, 1)
+		pipe(conn, buffered.Reader, r.Host)
+	}))
+	t.Cleanup(server.Close)
+	return server, &tunnels
+}
+
+/**
+  Send payload in frames of every length size, half close and read the echo
+**/
+func checkWebSocketEcho(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	// small, 16 bit and 64 bit lengths
+	payload := bytes.Repeat([]byte("0123456789"), 10000)
+	for _, part := range [][]byte{payload[:100], payload[100:60000], payload[60000:]} {
+		if _, err := conn.Write(part); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := closeWrite(conn); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte("late")); err != errWriteClosed {
+		t.Fatalf("write after half close: got %v, want %v", err, errWriteClosed)
+	}
+	echo, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(echo, payload) {
+		t.Fatalf("echo has %d bytes, want %d", len(echo), len(payload))
+	}
+}
+
+/**
+  Dial directly and through upstream http proxy, with and without its password
+**/
+func TestWebSocketDialAccept(t *testing.T) {
+	config := TransportConfig{Name: TransportWebSocket, Path: "/ws"}
+	address := webSocketEchoServer(t, newWebSocketTransport(config))
+	open, openTunnels := connectProxy(t, "", "")
+	auth, authTunnels := connectProxy(t, "carol", "secret")
+	authURL := strings.Replace(auth.URL, "http://", "http://carol:secret@", 1)
+	timeouts := Timeouts{Connect: time.Second, Handshake: 5 * time.Second}
+	for _, proxy := range []string{"", open.URL, authURL} {
+		config.Proxy = proxy
+		conn, err := newWebSocketTransport(config).Dial(address, timeouts)
+		if err != nil {
+			t.Fatalf("proxy %q: %v", proxy, err)
+		}
+		checkWebSocketEcho(t, conn)
+	}
+	if opened, authed := atomic.LoadInt32(openTunnels), atomic.LoadInt32(authTunnels); opened != 1 || authed != 1 {
+		t.Fatalf("%d and %d tunnels through upstream proxies, want 1 and 1", opened, authed)
+	}
+}
+
+/**
+  Upstream http proxy which refuses CONNECT fails the dial before any upgrade
+**/
+func TestWebSocketDialProxyRefused(t *testing.T) {
+	config := TransportConfig{Name: TransportWebSocket, Path: "/ws"}
+	address := webSocketEchoServer(t, newWebSocketTransport(config))
+	auth, tunnels := connectProxy(t, "carol", "secret")
+	for _, proxy := range []string{auth.URL, strings.Replace(auth.URL, "http://", "http://carol:wrong@", 1), "socks5://" + auth.Listener.Addr().String()} {
+		config.Proxy = proxy
+		if conn, err := newWebSocketTransport(config).Dial(address, Timeouts{Connect: time.Second, Handshake: time.Second}); err == nil {
+			_ = conn.Close()
+			t.Fatalf("proxy %q: dial worked", proxy)
+		}
+	}
+	if piped := atomic.LoadInt32(tunnels); piped != 0 {
+		t.Fatalf("%d tunnels without the right password", piped)
+	}
+}
+
+/**
+  A request which is not an upgrade of path is refused, and its bytes are given back for fallback
+**/
+func TestWebSocketAcceptRefuses(t *testing.T) {
+	transport := newWebSocketTransport(TransportConfig{Name: TransportWebSocket, Path: "/ws"})
+	for _, request := range []string{
+		"GET /ws HTTP/1.1\r\nHost: example.com\r\n\r\n",
+		"GET /other HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Key: a2V5\r\n\r\n",
+	} {
+		client, server := net.Pipe()
+		go func(request string) {
+			_, _ = client.Write([]byte(request))
+		}(request)
+		conn, received, err := transport.Accept(server)
+		_ = client.Close()
+		_ = server.Close()
+		if err == nil {
+			_ = conn.Close()
+			t.Fatalf("accepted %q", request)
+		}
+		if string(received) != request {
+			t.Fatalf("fallback gets %q, want %q", received, request)
+		}
+	}
+}
@@ -71,23 +71,35 @@ func generateKeys() [256]byte {
    Simple return encode value from encode table
 **/
 func (t *Table) Encode(keys []byte) []byte {
-	// Encode this byte array need jiacheng to change
 	values := make([]byte, len(keys))
-	for index, value := range keys {
-		values[index] = t.encode[value]
-	}
+	copy(values, keys)
+	t.EncodeInPlace(values)
 	return values
 }
 /**
    Simple return decode value from encode table
 **/
 func (t *Table) Decode(values []byte) []byte {
-	//Decode this byte array need jiacheng to change
 	keys := make([]byte, len(values))
+	copy(keys, values)
+	t.DecodeInPlace(keys)
+	return keys
+}
+/**
+   Encode every byte in the same array, nothing is allocated
+**/
+func (t *Table) EncodeInPlace(keys []byte) {
+	for index, value := range keys {
+		keys[index] = t.encode[value]
+	}
+}
+/**
+   Decode every byte in the same array, nothing is allocated
+**/
+func (t *Table) DecodeInPlace(values []byte) {
 	for index, value := range values {
-		keys[index] = t.decode[value]
+		values[index] = t.decode[value]
 	}
-	return keys
 }
 /**
    Simple getter for encode table
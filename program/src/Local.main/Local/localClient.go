@@ -0,0 +1,618 @@
+/**
+  Author: JiaCheng Yang && Wenkai Zheng
+  This file is used for declaring main methods for local proxy
+  Client struct keeps the session with server proxy
+  And handles every request from user application
+**/
+package Local
+
+import (
+	"Authentication"
+	"Core"
+	"Encryption"
+	"Logging"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/**
+  Routes of one connection
+**/
+const (
+	RouteProxy  = "proxy"
+	RouteDirect = "direct"
+)
+
+/**
+  Info is the config which can be changed by dashboard
+  ControlTcpConn is the first tcp conn which is used for heartbeat
+  Control and liveness are used for ping and pong on control tcp conn
+  Table is the encryption table which is sent to server proxy
+  Connections contains every running local connection
+  Listeners are kept so that shutdown can stop accepting, tunnel listeners are for static tunnels
+  Dns is the dns forwarder, nil when it is not started
+  Stopping becomes 1 when local proxy is shutting down
+  Reconnect wakes up the go routine which connects server proxy again
+  ConnectMutex makes sure only one session is signing in
+**/
+type Client struct {
+	mutex          sync.Mutex
+	info           ServerInfo
+	proxy          *Core.Proxy
+	table          *Encryption.Table
+	transport      Core.Transport
+	controlTcpConn net.Conn
+	control        *Core.ControlChannel
+	liveness       *Core.Liveness
+	status         *Status
+	connections    sync.Map
+	listeners      []*net.TCPListener
+	tunnels        []*net.TCPListener
+	dns            *dnsForwarder
+	stopping       int32
+	reconnect      chan struct{}
+	connectMutex   sync.Mutex
+}
+
+/**
+  One running connection and the way it goes
+**/
+type localConnection struct {
+	handler *Core.ConnectionHandler
+	route   string
+}
+
+/**
+  Simple constructor for Client
+**/
+func NewClient(info ServerInfo) (*Client, error) {
+	proxy, err := Core.NewLocalProxy(info.GetLocalAddr(), info.GetServerAddr())
+	if err != nil {
+		return nil, err
+	}
+	// sign in is never sent to a server proxy which can not be verified
+	if info.Transport == Core.TransportTLS && info.TLSCA == "" && info.TLSPin == "" {
+		if !info.TLSInsecure {
+			return nil, Core.ErrTLSNotVerified
+		}
+		Logging.NormalLogger.Println("tls_insecure is set, tls transport does not verify server proxy")
+	}
+	return &Client{info: info, proxy: proxy, status: newStatus(), reconnect: make(chan struct{}, 1)}, nil
+}
+
+/**
+  Simple getter for a copy of server info
+**/
+func (c *Client) GetInfo() ServerInfo {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.info
+}
+
+/**
+  Simple getter for server proxy address of current session
+**/
+func (c *Client) getServerHost() *net.TCPAddr {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.proxy.GetServerHost()
+}
+
+/**
+  Simple getter for encryption table of current session
+**/
+func (c *Client) getTable() *Encryption.Table {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.table
+}
+
+/**
+  Simple getter for transport of current session
+**/
+func (c *Client) getTransport() Core.Transport {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.transport
+}
+
+/**
+  This function will read all info and
+  Encode sending infos to serverproxy for verification
+  Password is not sent, a proof made by password, time and a random nonce is sent
+  So the same message can not be used again
+  and it expects a message from serverproxy which means
+  Success or Fail
+**/
+func signIn(serverInfo ServerInfo, serverTcpConn net.Conn) error {
+	// we need to send user name and proof to verify
+	// we need to make sure decode and encode table will be sent
+	username := Authentication.EncodeUsername(serverInfo.GetUserName())
+	password := Authentication.EncodePassword(serverInfo.GetPassword())
+	timestamp := make([]byte, Authentication.TimestampLength)
+	binary.BigEndian.PutUint64(timestamp, uint64(time.Now().Unix()))
+	nonce := make([]byte, Authentication.NonceLength)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	proof := Authentication.MakeProof(username, password, timestamp, nonce)
+	message := Core.ConvertStringTOByte(username)
+	message = append(message, timestamp...)
+	message = append(message, nonce...)
+	message = append(message, Core.ConvertStringTOByte(proof)...)
+	Logging.NormalLogger.Println("going to send username and proof")
+	check1, check2 := Core.WriteAll(message, serverTcpConn, len(message))
+	if check1 == -1 && check2 != nil {
+		return errors.New("encounter a error when sending username and proof")
+	}
+	// we expect the reply from
+	verification := make([]byte, 3, 3)
+	check1, check2 = Core.ReadAll(verification, serverTcpConn, 3)
+	if check1 == -1 && check2 != nil {
+		// server proxy says nothing to a refused client, it only times out or closes
+		return errors.New("server proxy did not accept sign in (wrong username, password, clock or banned)")
+	}
+	if !(Core.ByteArrEqual(verification, Core.SUCCESS)) {
+		return errors.New("wrong username and password")
+	}
+	Logging.NormalLogger.Println("correct")
+	return nil
+}
+
+/**
+   This function will send encryption table to server proxy
+   Same session will use same encode and decode table
+   The encryption table will be used as future transmissions
+**/
+func sendEncryptionTable(table *Encryption.Table, serverTcpConn net.Conn) error {
+	Logging.NormalLogger.Println("going to send encode arr")
+	encode := table.GetEncodeArr()
+	check1, check2 := Core.WriteAll(encode, serverTcpConn, 256)
+	if check1 == -1 && check2 != nil {
+		return errors.New("encounter a error when sending encode arr")
+	}
+
+	Logging.NormalLogger.Println("going to send decode arr")
+	decode := table.GetDecodeArr()
+	check1, check2 = Core.WriteAll(decode, serverTcpConn, 256)
+	if check1 == -1 && check2 != nil {
+		return errors.New("encounter a error when sending decode arr")
+	}
+	return nil
+}
+
+/**
+  Pre connect with server proxy
+  Send username, password, and encode, decode table
+  Also keep heartbeat mechanism to detect life cycle
+  Sign in must finish in handshake timeout seconds
+**/
+func (c *Client) Connect() error {
+	c.connectMutex.Lock()
+	defer c.connectMutex.Unlock()
+	// another go routine has signed in already
+	if c.isConnected() {
+		return nil
+	}
+	info := c.GetInfo()
+	c.status.setState(StateConnecting, nil)
+	timeout := time.Duration(info.GetTimeOut()) * time.Second
+	transport, err := Core.NewTransport(info.GetTransportConfig())
+	if err != nil {
+		c.status.setState(StateDisconnected, err)
+		return err
+	}
+	serverTcpConn, err := transport.Dial(info.GetServerAddr(), info.GetTimeouts())
+	if errs, ok := err.(net.Error); ok && errs.Timeout() {
+		err = errors.New("Timeout occurs when connect to server")
+	}
+	if err != nil {
+		c.status.setState(StateDisconnected, err)
+		return err
+	}
+	// a refused sign in is only found by this deadline
+	if handshake := info.GetTimeouts().Handshake; handshake > 0 {
+		err = Core.SetHandshakeDeadline(serverTcpConn, handshake)
+	} else if timeout > 0 {
+		err = serverTcpConn.SetDeadline(time.Now().Add(timeout))
+	}
+	if err == nil {
+		err = signIn(info, serverTcpConn)
+	}
+	if err == nil {
+		table := Encryption.NewEncryptionTable()
+		if err = sendEncryptionTable(table, serverTcpConn); err == nil {
+			err = serverTcpConn.SetDeadline(time.Time{})
+		}
+		if err == nil {
+			control := Core.NewControlChannel(serverTcpConn, table)
+			liveness := Core.NewLiveness(info.GetHeartBeatInterval(), info.GetHeartBeatMissCount())
+			c.mutex.Lock()
+			c.table = table
+			c.transport = transport
+			c.controlTcpConn = serverTcpConn
+			c.control = control
+			c.liveness = liveness
+			c.mutex.Unlock()
+			c.status.setState(StateConnected, nil)
+			go c.keepAlive(control, liveness)
+			go c.openReverseTunnels(control)
+			return nil
+		}
+	}
+	_ = serverTcpConn.Close()
+	c.status.setState(StateDisconnected, err)
+	return err
+}
+
+/**
+  This function sends a ping every interval and answers pings from server proxy
+  When pongs are missing for too long the session is lost
+  It stops when the session is replaced by another profile
+**/
+func (c *Client) keepAlive(control *Core.ControlChannel, liveness *Core.Liveness) {
+	stop := make(chan struct{})
+	go func() {
+		if err := Core.SendPings(control, liveness, stop); err != nil {
+			c.lostControl(control.GetConn(), err)
+		}
+	}()
+	err := Core.ReceiveFrames(control, liveness, c.handleControl)
+	close(stop)
+	c.lostControl(control.GetConn(), err)
+}
+
+/**
+  Simple getter for liveness of current session, nil if there is no session
+**/
+func (c *Client) getLiveness() *Core.Liveness {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.controlTcpConn == nil {
+		return nil
+	}
+	return c.liveness
+}
+
+/**
+  Simple getter for control channel of current session, nil if there is no session
+**/
+func (c *Client) getControl() *Core.ControlChannel {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.controlTcpConn == nil {
+		return nil
+	}
+	return c.control
+}
+
+/**
+  Check the control tcp conn is not used by current session anymore
+**/
+func (c *Client) isReplaced(serverTcpConn net.Conn) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.controlTcpConn != serverTcpConn
+}
+
+/**
+  Switch to another server profile
+  Old session is closed and a new one is signed in
+  If the new one fails we go back to the old profile
+**/
+func (c *Client) SwitchProfile(name string) error {
+	old := c.GetInfo()
+	info, err := old.WithProfile(name)
+	if err != nil {
+		return err
+	}
+	addr, err := net.ResolveTCPAddr("tcp", info.GetServerAddr())
+	if err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	oldControl := c.controlTcpConn
+	c.controlTcpConn = nil
+	c.info = info
+	err = c.proxy.SetServerHost(addr)
+	c.mutex.Unlock()
+	if oldControl != nil {
+		_ = oldControl.Close()
+	}
+	if err != nil {
+		return err
+	}
+	if err = c.Connect(); err != nil {
+		Logging.NormalLogger.Println("could not switch to profile", name)
+		oldAddr, _ := net.ResolveTCPAddr("tcp", old.GetServerAddr())
+		c.mutex.Lock()
+		c.info = old
+		_ = c.proxy.SetServerHost(oldAddr)
+		c.mutex.Unlock()
+		if reconnectErr := c.Connect(); reconnectErr != nil {
+			Logging.ErrorLogger.Println(reconnectErr)
+		}
+		return err
+	}
+	Logging.NormalLogger.Println("switched to profile", name)
+	return nil
+}
+
+/**
+  Change routing mode for future connections
+**/
+func (c *Client) SetMode(mode string) error {
+	if !IsValidMode(mode) {
+		return errors.New("unknown mode " + mode)
+	}
+	c.mutex.Lock()
+	c.info.Mode = mode
+	c.mutex.Unlock()
+	Logging.NormalLogger.Println("routing mode is", mode)
+	return nil
+}
+
+/**
+  Decide a target goes through server proxy or not
+**/
+func (c *Client) getRoute(target string) string {
+	switch c.GetInfo().GetMode() {
+	case ModeDirect:
+		return RouteDirect
+	case ModeBypassLan:
+		if isLanTarget(target) {
+			return RouteDirect
+		}
+	}
+	return RouteProxy
+}
+
+/**
+  This function connects to server proxy for one request
+  It repeats method negotiation and request to server proxy
+  Reply of request is read here and given to user application
+  Because data after it is sent in frames
+**/
+func (c *Client) connectServer(request []byte) (net.Conn, *Encryption.Table, error) {
+	table, transport := c.getTable(), c.getTransport()
+	if table == nil || transport == nil {
+		return nil, nil, errServerUnreachable
+	}
+	timeouts := c.GetInfo().GetTimeouts()
+	serverTcpConn, err := transport.Dial(c.getServerHost().String(), timeouts)
+	if err != nil {
+		// one failed dial does not mean server proxy is gone, heartbeat decides that
+		Logging.ErrorLogger.Println(err)
+		c.probeControl()
+		return nil, nil, errServerUnreachable
+	}
+	err = Core.SetHandshakeDeadline(serverTcpConn, timeouts.Handshake)
+	if err != nil {
+		_ = serverTcpConn.Close()
+		return nil, nil, err
+	}
+	greeting := table.Encode([]byte{Core.SocksVersion, 0x1, Core.SocksNoAuth})
+	if _, err = Core.WriteAll(greeting, serverTcpConn, len(greeting)); err == nil {
+		method := make([]byte, 2)
+		if _, err = Core.ReadAll(method, serverTcpConn, 2); err == nil {
+			method = table.Decode(method)
+			if method[0] != Core.SocksVersion || method[1] != Core.SocksNoAuth {
+				err = errors.New("server proxy refused method negotiation")
+			} else {
+				encodeRequest := table.Encode(request)
+				_, err = Core.WriteAll(encodeRequest, serverTcpConn, len(encodeRequest))
+			}
+		}
+	}
+	if err == nil {
+		err = readServerReply(table, serverTcpConn)
+	}
+	if err == nil {
+		err = Core.SetHandshakeDeadline(serverTcpConn, 0)
+	}
+	if err != nil {
+		_ = serverTcpConn.Close()
+		return nil, nil, err
+	}
+	return serverTcpConn, table, nil
+}
+
+/**
+  Server proxy always replies with ipv4 bind address (10 bytes)
+**/
+func readServerReply(table *Encryption.Table, serverTcpConn net.Conn) error {
+	reply := make([]byte, 10)
+	if _, err := Core.ReadAll(reply, serverTcpConn, 10); err != nil {
+		return err
+	}
+	reply = table.Decode(reply)
+	if reply[0] != Core.SocksVersion {
+		return errors.New("server proxy replied with wrong version")
+	}
+	if reply[1] != Core.SocksSucceeded {
+		return &socksError{reply: reply[1]}
+	}
+	return nil
+}
+
+/**
+  This function handles one request from user application
+  Once the target is known, it connects either with server proxy or the target
+  construt a new connection handler
+  And go into Transfer data part
+**/
+func (c *Client) handleConnection(localTcpConn net.Conn) {
+	timeouts := c.GetInfo().GetTimeouts()
+	// user application which does not finish socks5 negotiation is closed
+	if err := Core.SetHandshakeDeadline(localTcpConn, timeouts.Handshake); err != nil {
+		Logging.ErrorLogger.Println(err)
+		_ = localTcpConn.Close()
+		return
+	}
+	if err := acceptSocksGreeting(localTcpConn); err != nil {
+		Logging.ErrorLogger.Println(err)
+		_ = localTcpConn.Close()
+		return
+	}
+	request, target, err := readSocksRequest(localTcpConn)
+	if err != nil {
+		Logging.ErrorLogger.Println(err)
+		_ = localTcpConn.Close()
+		return
+	}
+	if request[1] != Core.SocksConnect {
+		_ = writeSocksReply(localTcpConn, Core.SocksCommandNotSupported)
+		_ = localTcpConn.Close()
+		return
+	}
+	route := c.getRoute(target)
+	c.status.addHistory(target, route)
+	var serverTcpConn net.Conn
+	var table *Encryption.Table
+	if route == RouteDirect {
+		if serverTcpConn, err = Core.DialTCP(target, timeouts.Connect); err == nil {
+			err = writeSocksReply(localTcpConn, Core.SocksSucceeded)
+		}
+	} else {
+		if serverTcpConn, table, err = c.connectServer(request); err == nil {
+			err = writeSocksReply(localTcpConn, Core.SocksSucceeded)
+		}
+	}
+	if err == nil {
+		err = Core.SetHandshakeDeadline(localTcpConn, 0)
+	}
+	if err != nil {
+		Logging.NormalLogger.Println("could not connect to", target)
+		Logging.ErrorLogger.Println(err)
+		reply := byte(Core.SocksHostUnreachable)
+		if err == errServerUnreachable {
+			reply = Core.SocksNetworkUnreachable
+		} else if errs, ok := err.(*socksError); ok {
+			reply = errs.reply
+		} else if route == RouteProxy {
+			reply = Core.SocksGeneralFailure
+		}
+		_ = writeSocksReply(localTcpConn, reply)
+		_ = localTcpConn.Close()
+		if serverTcpConn != nil {
+			_ = serverTcpConn.Close()
+		}
+		return
+	}
+	Logging.NormalLogger.Println("accepted a connection to", target, "by", route)
+	c.relay(localTcpConn, serverTcpConn, table, target, route)
+}
+
+/**
+  This function transfers data of one connection until it is closed
+  Table is nil for direct connections
+**/
+func (c *Client) relay(localTcpConn, serverTcpConn net.Conn, table *Encryption.Table, target, route string) {
+	timeouts := c.GetInfo().GetTimeouts()
+	connection := Core.NewConnectionHandler(localTcpConn, serverTcpConn, c.proxy.GetDevice(), table)
+	connection.SetTarget(target)
+	connection.SetTimeouts(timeouts.Idle, timeouts.Lifetime)
+	c.connections.Store(connection, &localConnection{handler: connection, route: route})
+	connection.TransferData()
+	c.connections.Delete(connection)
+}
+
+/**
+  This function will listen local port for user application
+  Once there is any new request, it is handled in another go routine
+  Ipv6 loopback is skipped when the system has no ipv6
+**/
+func (c *Client) Listen() error {
+	var listeners []*net.TCPListener
+	for i, address := range c.GetInfo().GetListenAddrs() {
+		Logging.NormalLogger.Println("going to listen:", address)
+		// as a server for localhost
+		tcpAddr, err := net.ResolveTCPAddr("tcp", address)
+		var tcpListener *net.TCPListener
+		if err == nil {
+			tcpListener, err = net.ListenTCP("tcp", tcpAddr)
+		}
+		if err != nil {
+			if i > 0 && c.GetInfo().LocalAddr == "" {
+				Logging.NormalLogger.Println("could not listen on", address, err)
+				continue
+			}
+			for _, listener := range listeners {
+				_ = listener.Close()
+			}
+			return err
+		}
+		listeners = append(listeners, tcpListener)
+	}
+	c.mutex.Lock()
+	c.listeners = listeners
+	c.mutex.Unlock()
+	// signal came before listener is ready
+	if atomic.LoadInt32(&c.stopping) == 1 {
+		c.closeListeners()
+		return nil
+	}
+	Logging.NormalLogger.Println("local is waiting for connection")
+	errs := make(chan error, len(listeners))
+	for _, tcpListener := range listeners {
+		go func(tcpListener *net.TCPListener) {
+			errs <- c.accept(tcpListener)
+		}(tcpListener)
+	}
+	var result error
+	for range listeners {
+		// one broken listener stops all of them
+		if err := <-errs; err != nil && result == nil {
+			result = err
+			c.closeListeners()
+		}
+	}
+	return result
+}
+
+/**
+  Accept user applications until the listener is closed
+**/
+func (c *Client) accept(tcpListener *net.TCPListener) error {
+	for {
+		localTcpConn, err := tcpListener.AcceptTCP()
+		if err != nil {
+			// listener is closed by shutdown
+			if atomic.LoadInt32(&c.stopping) == 1 {
+				return nil
+			}
+			_ = tcpListener.Close()
+			return err
+		}
+		go c.handleConnection(localTcpConn)
+	}
+}
+
+/**
+  Close all listeners and tunnels, Listen returns after it
+**/
+func (c *Client) closeListeners() {
+	c.mutex.Lock()
+	listeners := append(append([]*net.TCPListener(nil), c.listeners...), c.tunnels...)
+	c.mutex.Unlock()
+	for _, listener := range listeners {
+		_ = listener.Close()
+	}
+}
+
+/**
+  Collect all running connections
+**/
+func (c *Client) getConnections() []*localConnection {
+	var connections []*localConnection
+	c.connections.Range(func(key interface{}, value interface{}) bool {
+		connections = append(connections, value.(*localConnection))
+		return true
+	})
+	return connections
+}
@@ -0,0 +1,302 @@
+/**
+  Author: JiaCheng Yang && Wenkai Zheng
+  This file is used for dns forwarder of local proxy
+  Applications ask it over udp or tcp, queries go on control tcp conn to resolver of server proxy
+  So names are not resolved on the network of local proxy and answers can not be poisoned there
+  Names which match dns direct are resolved by system resolver or dns direct server instead
+**/
+package Local
+
+import (
+	"Core"
+	"Logging"
+	"Resolver"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/**
+  Ttl of answers from system resolver, it does not tell the real ttl
+**/
+const directTTL = 60
+
+/**
+  Tcp clients are closed after this time without a query
+**/
+const dnsIdleTimeout = 10 * time.Second
+
+var errNoSession = errors.New("no session with server proxy")
+
+/**
+  Dns forwarder of local proxy
+  Direct is the list of domain suffixes for system resolver
+  Direct resolver is used for direct names when dns direct server is set, nil means system resolver
+  Next id gives each tunneled query its own id, pending keeps the channel which waits for its answer
+**/
+type dnsForwarder struct {
+	client         *Client
+	direct         []string
+	directResolver *Resolver.Resolver
+	timeout        time.Duration
+	nextID         uint32
+	pending        sync.Map
+	udpConn        *net.UDPConn
+	tcpListener    *net.TCPListener
+}
+
+/**
+  Start listening on dns addr over udp and tcp
+**/
+func (c *Client) StartDNS() error {
+	info := c.GetInfo()
+	forwarder := &dnsForwarder{client: c, timeout: info.GetDNSTimeout()}
+	for _, name := range info.DNSDirect {
+		if name = strings.ToLower(strings.Trim(name, ".")); name != "" {
+			forwarder.direct = append(forwarder.direct, name)
+		}
+	}
+	if info.DNSDirectServer != "" {
+		resolver, err := Resolver.NewResolver(Resolver.Config{
+			Servers: []string{info.DNSDirectServer},
+			Timeout: forwarder.timeout,
+		})
+		if err != nil {
+			return err
+		}
+		forwarder.directResolver = resolver
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp", info.GetDNSAddr())
+	if err != nil {
+		return err
+	}
+	tcpAddr, err := net.ResolveTCPAddr("tcp", info.GetDNSAddr())
+	if err != nil {
+		return err
+	}
+	if forwarder.udpConn, err = net.ListenUDP("udp", udpAddr); err != nil {
+		return err
+	}
+	if forwarder.tcpListener, err = net.ListenTCP("tcp", tcpAddr); err != nil {
+		_ = forwarder.udpConn.Close()
+		return err
+	}
+	c.mutex.Lock()
+	c.dns = forwarder
+	c.mutex.Unlock()
+	Logging.NormalLogger.Println("dns forwarder is listening on", info.GetDNSAddr())
+	go forwarder.serveUDP()
+	go forwarder.serveTCP()
+	return nil
+}
+
+/**
+  Stop both listeners, queries which are running still finish
+**/
+func (d *dnsForwarder) close() {
+	if err := d.udpConn.Close(); err != nil {
+		Logging.ErrorLogger.Println(err)
+	}
+	if err := d.tcpListener.Close(); err != nil {
+		Logging.ErrorLogger.Println(err)
+	}
+}
+
+/**
+  Each udp query is answered in its own go routine
+**/
+func (d *dnsForwarder) serveUDP() {
+	buffer := make([]byte, 65535)
+	for {
+		readLength, addr, err := d.udpConn.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+		query := append([]byte(nil), buffer[:readLength]...)
+		go func() {
+			response := d.answer(query)
+			if response == nil {
+				return
+			}
+			if _, err := d.udpConn.WriteToUDP(Resolver.FitUDP(query, response), addr); err != nil {
+				Logging.ErrorLogger.Println(err)
+			}
+		}()
+	}
+}
+
+func (d *dnsForwarder) serveTCP() {
+	for {
+		conn, err := d.tcpListener.AcceptTCP()
+		if err != nil {
+			return
+		}
+		go d.handleTCP(conn)
+	}
+}
+
+/**
+  Over tcp each message has 2 bytes of length before it, a client can send many queries
+**/
+func (d *dnsForwarder) handleTCP(conn *net.TCPConn) {
+	defer conn.Close()
+	for {
+		if err := conn.SetDeadline(time.Now().Add(dnsIdleTimeout + d.timeout)); err != nil {
+			return
+		}
+		length := make([]byte, 2)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return
+		}
+		query := make([]byte, binary.BigEndian.Uint16(length))
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+		response := d.answer(query)
+		if response == nil {
+			return
+		}
+		message := make([]byte, 2+len(response))
+		binary.BigEndian.PutUint16(message, uint16(len(response)))
+		copy(message[2:], response)
+		if _, err := Core.WriteAll(message, conn, len(message)); err != nil {
+			return
+		}
+	}
+}
+
+/**
+  Resolve a query directly or through the tunnel
+  A query which fails gets server failure, a message which is not a query gets nothing
+**/
+func (d *dnsForwarder) answer(query []byte) []byte {
+	name, qtype, err := Resolver.ParseQuestion(query)
+	if err != nil {
+		return nil
+	}
+	var response []byte
+	if d.isDirect(name) {
+		response, err = d.resolveDirect(query, name, qtype)
+	} else {
+		response, err = d.resolveTunnel(query)
+	}
+	if err != nil {
+		Logging.ErrorLogger.Println("could not resolve", name, err)
+		response, _ = Resolver.NewErrorResponse(query, Resolver.RcodeServerFailure)
+	}
+	return response
+}
+
+/**
+  A name is direct when it is a direct domain or under one
+**/
+func (d *dnsForwarder) isDirect(name string) bool {
+	name = strings.TrimSuffix(name, ".")
+	for _, domain := range d.direct {
+		if name == domain || strings.HasSuffix(name, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+  System resolver only gives addresses, so other types are not implemented without dns direct server
+**/
+func (d *dnsForwarder) resolveDirect(query []byte, name string, qtype uint16) ([]byte, error) {
+	if d.directResolver != nil {
+		return d.directResolver.Exchange(query)
+	}
+	if qtype != Resolver.TypeA && qtype != Resolver.TypeAAAA {
+		return Resolver.NewErrorResponse(query, Resolver.RcodeNotImplemented)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, name)
+	if errs, ok := err.(*net.DNSError); ok && errs.IsNotFound {
+		return Resolver.NewErrorResponse(query, Resolver.RcodeNameError)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+	return Resolver.NewResponse(query, qtype, ips, directTTL)
+}
+
+/**
+  Send a query on control tcp conn and wait for its answer
+  Queries of all applications share one id space, so the id is changed and changed back in the answer
+**/
+func (d *dnsForwarder) resolveTunnel(query []byte) ([]byte, error) {
+	control := d.client.getControl()
+	if control == nil {
+		d.client.requestReconnect()
+		return nil, errNoSession
+	}
+	id := uint16(atomic.AddUint32(&d.nextID, 1))
+	tunneled := append([]byte(nil), query...)
+	binary.BigEndian.PutUint16(tunneled, id)
+	answers := make(chan []byte, 1)
+	d.pending.Store(id, answers)
+	defer d.pending.Delete(id)
+	if err := control.WriteFrame(Core.ControlDNSQuery, tunneled); err != nil {
+		return nil, err
+	}
+	timer := time.NewTimer(d.timeout)
+	defer timer.Stop()
+	select {
+	case response := <-answers:
+		copy(response, query[:2])
+		return response, nil
+	case <-timer.C:
+		return nil, errors.New("dns query timeout")
+	}
+}
+
+/**
+  Give an answer from server proxy to the query which waits for it, late answers are dropped
+**/
+func (d *dnsForwarder) deliver(response []byte) {
+	if len(response) < 2 {
+		return
+	}
+	value, ok := d.pending.Load(binary.BigEndian.Uint16(response))
+	if !ok {
+		return
+	}
+	select {
+	case value.(chan []byte) <- response:
+	default:
+	}
+}
+
+/**
+  Frames which are not ping or pong come here, they are dns answers and reverse tunnel frames
+**/
+func (c *Client) handleControl(frameType byte, payload []byte) error {
+	switch frameType {
+	case Core.ControlReverseReply:
+		return c.reverseReplied(payload)
+	case Core.ControlReverseConnect:
+		return c.reverseConnected(payload)
+	case Core.ControlDNSAnswer:
+	default:
+		return errors.New("unknown control frame")
+	}
+	c.mutex.Lock()
+	forwarder := c.dns
+	c.mutex.Unlock()
+	if forwarder != nil {
+		forwarder.deliver(payload)
+	}
+	return nil
+}
@@ -0,0 +1,234 @@
+/**
+  Author: JiaCheng Yang && Wenkai Zheng
+  This file is used for the web dashboard of local proxy
+  Web pages are embedded into the binary
+  Json api shows status, connections and history and changes profile and mode
+**/
+package Local
+
+import (
+	"Core"
+	"Logging"
+	"embed"
+	"encoding/json"
+	"io/fs"
+	"net"
+	"net/http"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed web
+var webFiles embed.FS
+
+/**
+  Json format of status
+**/
+type statusInfo struct {
+	State         string    `json:"state"`
+	Since         time.Time `json:"since"`
+	LastError     string    `json:"last_error"`
+	Profile       string    `json:"profile"`
+	Profiles      []string  `json:"profiles"`
+	Server        string    `json:"server"`
+	Local         string    `json:"local"`
+	Mode          string    `json:"mode"`
+	Modes         []string  `json:"modes"`
+	Liveness      string    `json:"liveness"`
+	RttMs         float64   `json:"rtt_ms"`
+	SmoothedRttMs float64   `json:"smoothed_rtt_ms"`
+}
+
+/**
+  Json format of one connection
+**/
+type connectionInfo struct {
+	Id            uint64    `json:"id"`
+	Target        string    `json:"target"`
+	Route         string    `json:"route"`
+	UploadBytes   int64     `json:"upload_bytes"`
+	DownloadBytes int64     `json:"download_bytes"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+/**
+  This function starts dashboard in another go routine
+  It returns the url of dashboard
+**/
+func (c *Client) StartDashboard() (string, error) {
+	listener, err := net.Listen("tcp", c.GetInfo().GetDashboardAddr())
+	if err != nil {
+		return "", err
+	}
+	web, err := fs.Sub(webFiles, "web")
+	if err != nil {
+		return "", err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/", http.FileServer(http.FS(web)))
+	mux.HandleFunc("/api/status", c.dashboardStatus)
+	mux.HandleFunc("/api/connections", c.dashboardConnections)
+	mux.HandleFunc("/api/history", c.dashboardHistory)
+	mux.HandleFunc("/api/profile", c.dashboardProfile)
+	mux.HandleFunc("/api/mode", c.dashboardMode)
+	handler := checkHost(mux, listener.Addr().(*net.TCPAddr).Port)
+	go func() {
+		if err := http.Serve(listener, handler); err != nil {
+			Logging.ErrorLogger.Println(err)
+		}
+	}()
+	url := "http://" + listener.Addr().String() + "/"
+	Logging.NormalLogger.Println("dashboard is running on", url)
+	return url, nil
+}
+
+/**
+  Open the dashboard in default browser
+  Failure is not fatal because there is no browser on headless box
+**/
+func OpenBrowser(url string) error {
+	var args []string
+	switch runtime.GOOS {
+	case "darwin":
+		args = []string{"open", url}
+	case "windows":
+		args = []string{"cmd", "/c", "start", url}
+	default:
+		args = []string{"xdg-open", url}
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	return cmd.Start()
+}
+
+/**
+  Write any value as json
+**/
+func writeJson(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		Logging.ErrorLogger.Println(err)
+	}
+}
+
+/**
+  Dashboard only answers requests for loopback names with its own port
+  A web site which rebinds its name to 127.0.0.1 sends its own name as host, so it is refused
+**/
+func checkHost(next http.Handler, port int) http.Handler {
+	allowed := make(map[string]bool)
+	for _, host := range []string{"localhost", "127.0.0.1", "::1"} {
+		allowed[net.JoinHostPort(host, strconv.Itoa(port))] = true
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !allowed[strings.ToLower(r.Host)] {
+			writeJson(w, http.StatusForbidden, map[string]string{"error": "forbidden host"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+/**
+  Changes need POST and a custom header
+  So that other web sites cannot send them from browser
+**/
+func checkControl(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		writeJson(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return false
+	}
+	if r.Header.Get("X-Requested-With") == "" {
+		writeJson(w, http.StatusForbidden, map[string]string{"error": "forbidden"})
+		return false
+	}
+	return true
+}
+
+/**
+  GET /api/status
+**/
+func (c *Client) dashboardStatus(w http.ResponseWriter, r *http.Request) {
+	info := c.GetInfo()
+	state, since, lastError := c.status.getState()
+	var profiles []string
+	for _, profile := range info.GetProfiles() {
+		profiles = append(profiles, profile.Name)
+	}
+	liveness := Core.LivenessDead
+	var rtt, smoothedRtt time.Duration
+	if l := c.getLiveness(); l != nil {
+		liveness = l.GetState()
+		rtt, smoothedRtt = l.GetRtt()
+	}
+	writeJson(w, http.StatusOK, statusInfo{
+		State:         state,
+		Since:         since,
+		LastError:     lastError,
+		Profile:       info.GetProfile(),
+		Profiles:      profiles,
+		Server:        info.GetServerAddr(),
+		Local:         info.GetLocalAddr(),
+		Mode:          info.GetMode(),
+		Modes:         []string{ModeGlobal, ModeBypassLan, ModeDirect},
+		Liveness:      liveness,
+		RttMs:         float64(rtt) / float64(time.Millisecond),
+		SmoothedRttMs: float64(smoothedRtt) / float64(time.Millisecond),
+	})
+}
+
+/**
+  GET /api/connections
+**/
+func (c *Client) dashboardConnections(w http.ResponseWriter, r *http.Request) {
+	infos := []connectionInfo{}
+	for _, connection := range c.getConnections() {
+		infos = append(infos, connectionInfo{
+			Id:            connection.handler.GetId(),
+			Target:        connection.handler.GetTarget(),
+			Route:         connection.route,
+			UploadBytes:   connection.handler.GetUploadBytes(),
+			DownloadBytes: connection.handler.GetDownloadBytes(),
+			CreatedAt:     connection.handler.GetCreatedAt(),
+		})
+	}
+	writeJson(w, http.StatusOK, infos)
+}
+
+/**
+  GET /api/history
+**/
+func (c *Client) dashboardHistory(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, http.StatusOK, c.status.getHistory())
+}
+
+/**
+  POST /api/profile?name=profile
+**/
+func (c *Client) dashboardProfile(w http.ResponseWriter, r *http.Request) {
+	if !checkControl(w, r) {
+		return
+	}
+	if err := c.SwitchProfile(r.URL.Query().Get("name")); err != nil {
+		writeJson(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJson(w, http.StatusOK, map[string]string{"profile": c.GetInfo().GetProfile()})
+}
+
+/**
+  POST /api/mode?mode=global
+**/
+func (c *Client) dashboardMode(w http.ResponseWriter, r *http.Request) {
+	if !checkControl(w, r) {
+		return
+	}
+	if err := c.SetMode(r.URL.Query().Get("mode")); err != nil {
+		writeJson(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJson(w, http.StatusOK, map[string]string{"mode": c.GetInfo().GetMode()})
+}
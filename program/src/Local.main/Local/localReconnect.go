@@ -0,0 +1,128 @@
+/**
+  Author: JiaCheng Yang && Wenkai Zheng
+  This file is used for connecting server proxy again
+  When control tcp conn is lost, local proxy keeps listening
+  And signs in again with exponential backoff and jitter
+**/
+package Local
+
+import (
+	"Core"
+	"Logging"
+	"errors"
+	"math/rand"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+/**
+  Delay of the first retry and the longest delay
+**/
+const reconnectMinDelay = 1 * time.Second
+const reconnectMaxDelay = 60 * time.Second
+
+/**
+  New requests get this error when there is no session with server proxy
+**/
+var errServerUnreachable = errors.New("server proxy is unreachable")
+
+/**
+  Start the go routine which keeps session with server proxy
+  And sign in for the first time
+**/
+func (c *Client) Start() {
+	go c.keepConnected()
+	c.requestReconnect()
+}
+
+/**
+  Wake up keepConnected, it does nothing if it is already waked up
+**/
+func (c *Client) requestReconnect() {
+	select {
+	case c.reconnect <- struct{}{}:
+	default:
+	}
+}
+
+/**
+  Check there is a session with server proxy
+**/
+func (c *Client) isConnected() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.controlTcpConn != nil
+}
+
+/**
+  This function is called when control tcp conn is broken
+  It is ignored when the conn is already replaced (switch profile or shutdown)
+**/
+func (c *Client) lostControl(serverTcpConn net.Conn, err error) {
+	c.mutex.Lock()
+	if serverTcpConn == nil || c.controlTcpConn != serverTcpConn {
+		c.mutex.Unlock()
+		return
+	}
+	c.controlTcpConn = nil
+	c.table = nil
+	c.mutex.Unlock()
+	_ = serverTcpConn.Close()
+	if err == nil {
+		err = errors.New("control connection is closed")
+	}
+	Logging.NormalLogger.Println("lost connection with server proxy")
+	Logging.ErrorLogger.Println(err)
+	c.status.setState(StateDisconnected, err)
+	c.requestReconnect()
+}
+
+/**
+  Send a ping at once, so a dead control tcp conn is found by write error or missing pong
+  Instead of waiting for next heartbeat
+**/
+func (c *Client) probeControl() {
+	control, liveness := c.getControl(), c.getLiveness()
+	if control == nil || liveness == nil {
+		return
+	}
+	if err := control.WriteFrame(Core.ControlPing, liveness.NextPing()); err != nil {
+		c.lostControl(control.GetConn(), err)
+	}
+}
+
+/**
+  The delay doubles after every failure until max delay
+  Half of it is random so that many local proxies do not retry at same time
+**/
+func nextDelay(delay time.Duration) (time.Duration, time.Duration) {
+	sleep := delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+	delay *= 2
+	if delay > reconnectMaxDelay {
+		delay = reconnectMaxDelay
+	}
+	return sleep, delay
+}
+
+/**
+  This function waits for reconnect requests
+  And signs in again until it succeeds or local proxy is stopping
+**/
+func (c *Client) keepConnected() {
+	for range c.reconnect {
+		delay := reconnectMinDelay
+		for !c.isConnected() && atomic.LoadInt32(&c.stopping) == 0 {
+			err := c.Connect()
+			if err == nil {
+				Logging.NormalLogger.Println("signed in server proxy")
+				break
+			}
+			var sleep time.Duration
+			sleep, delay = nextDelay(delay)
+			Logging.NormalLogger.Println("could not sign in server proxy, retry in", sleep)
+			Logging.ErrorLogger.Println(err)
+			time.Sleep(sleep)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+/**
+  Author: JiaCheng Yang && Wenkai Zheng
+  This file is used for reverse tunnels of local proxy, the way ssh -R works
+  A service next to local proxy is published on a port of server proxy host
+  Server proxy tells about each conn it accepts on that port, and local proxy connects it to the target
+**/
+package Local
+
+import (
+	"Core"
+	"Logging"
+	"encoding/binary"
+	"errors"
+	"strconv"
+)
+
+/**
+  Route of connections of reverse tunnels
+**/
+const RouteReverse = "reverse"
+
+/**
+  One reverse tunnel in config file, remote port is on server proxy host and target is host:port next to local proxy
+  Remote port must be granted to the user in server config
+**/
+type ReverseTunnel struct {
+	RemotePort int    `json:"remote_port"`
+	Target     string `json:"target"`
+}
+
+/**
+  Ask server proxy to listen on remote ports, it is done after every sign in
+  Server proxy stops listening when the session is closed
+**/
+func (c *Client) openReverseTunnels(control *Core.ControlChannel) {
+	for _, tunnel := range c.GetInfo().ReverseTunnels {
+		payload := make([]byte, 2)
+		binary.BigEndian.PutUint16(payload, uint16(tunnel.RemotePort))
+		if err := control.WriteFrame(Core.ControlReverseOpen, payload); err != nil {
+			Logging.ErrorLogger.Println("could not open reverse tunnel", tunnel.RemotePort, err)
+			return
+		}
+	}
+}
+
+/**
+  Reverse reply frame, a refused or failed port is only logged
+**/
+func (c *Client) reverseReplied(payload []byte) error {
+	if len(payload) != 3 {
+		return errors.New("wrong reverse reply frame")
+	}
+	port := int(binary.BigEndian.Uint16(payload))
+	switch payload[2] {
+	case Core.ReverseOK:
+		Logging.NormalLogger.Println("reverse tunnel listens on port", port, "of server proxy")
+	case Core.ReverseRefused:
+		Logging.ErrorLogger.Println("reverse port", port, "is not granted by server proxy")
+	default:
+		Logging.ErrorLogger.Println("server proxy could not listen on reverse port", port)
+	}
+	return nil
+}
+
+/**
+  Reverse connect frame, connecting takes time, so it runs in another go routine and heartbeat is not blocked
+**/
+func (c *Client) reverseConnected(payload []byte) error {
+	if len(payload) <= 2 || len(payload) > 2+255 {
+		return errors.New("wrong reverse connect frame")
+	}
+	port := int(binary.BigEndian.Uint16(payload))
+	id := string(payload[2:])
+	for _, tunnel := range c.GetInfo().ReverseTunnels {
+		if tunnel.RemotePort == port {
+			go c.handleReverse(id, port, tunnel.Target)
+			return nil
+		}
+	}
+	// conn on a port which is not in config anymore waits until server proxy closes it
+	Logging.NormalLogger.Println("no reverse tunnel for port", port)
+	return nil
+}
+
+/**
+  Connect the target first, so a target which is down only costs the conn which server proxy accepted
+  Then take that conn by reverse command with its id as the name of address
+**/
+func (c *Client) handleReverse(id string, port int, target string) {
+	name := "server:" + strconv.Itoa(port) + " -> " + target
+	c.status.addHistory(name, RouteReverse)
+	targetTcpConn, err := Core.DialTCP(target, c.GetInfo().GetTimeouts().Connect)
+	if err != nil {
+		Logging.NormalLogger.Println("could not connect reverse tunnel to", target)
+		Logging.ErrorLogger.Println(err)
+		return
+	}
+	request := append([]byte{Core.SocksVersion, Core.SocksReverse, 0x00}, (&Core.SocksAddr{Type: Core.DomainName, Name: id, Port: port}).Bytes()...)
+	serverTcpConn, table, err := c.connectServer(request)
+	if err != nil {
+		Logging.NormalLogger.Println("could not take reverse conn on port", port)
+		Logging.ErrorLogger.Println(err)
+		_ = targetTcpConn.Close()
+		return
+	}
+	Logging.NormalLogger.Println("accepted a connection to", name, "by", RouteReverse)
+	c.relay(targetTcpConn, serverTcpConn, table, name, RouteReverse)
+}
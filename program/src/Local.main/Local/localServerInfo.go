@@ -5,27 +5,98 @@
 **/
 package Local
 
-import "strconv"
+import (
+	"Core"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
 
-type ServerInfo struct {
+/**
+  Routing modes for local proxy
+  Global sends everything to server proxy
+  Direct connects everything without server proxy
+  BypassLan connects private addresses directly and others go to server proxy
+**/
+const (
+	ModeGlobal    = "global"
+	ModeDirect    = "direct"
+	ModeBypassLan = "bypass_lan"
+)
+
+/**
+  Name of the profile which is made from top level server fields
+**/
+const DefaultProfile = "default"
+
+/**
+  One server profile, the dashboard can switch between them
+**/
+type Profile struct {
+	Name       string `json:"name"`
 	Server     string `json:"server"`
 	ServerPort int    `json:"server_port"`
-	LocalPort  int    `json:"local_port"`
 	Password   string `json:"password"`
-	Timeout    int    `json:"timeout"`
 	UserName   string `json:"username"`
 }
+
+type ServerInfo struct {
+	Server             string          `json:"server"`
+	ServerPort         int             `json:"server_port"`
+	LocalAddr          string          `json:"local_addr"`
+	LocalPort          int             `json:"local_port"`
+	Password           string          `json:"password"`
+	Timeout            int             `json:"timeout"`
+	UserName           string          `json:"username"`
+	DashboardPort      int             `json:"dashboard_port"`
+	OpenBrowser        bool            `json:"open_browser"`
+	Mode               string          `json:"mode"`
+	Profiles           []Profile       `json:"profiles"`
+	DrainTimeout       int             `json:"drain_timeout"`
+	HeartBeatInterval  int             `json:"heartbeat_interval"`
+	HeartBeatMissCount int             `json:"heartbeat_miss_count"`
+	HandshakeTimeout   int             `json:"handshake_timeout"`
+	IdleTimeout        int             `json:"idle_timeout"`
+	MaxLifetime        int             `json:"max_lifetime"`
+	Transport          string          `json:"transport"`
+	TransportPath      string          `json:"transport_path"`
+	TransportHost      string          `json:"transport_host"`
+	TransportProxy     string          `json:"transport_proxy"`
+	TLSCA              string          `json:"tls_ca"`
+	TLSPin             string          `json:"tls_pin"`
+	TLSInsecure        bool            `json:"tls_insecure"`
+	DNSPort            int             `json:"dns_port"`
+	DNSDirect          []string        `json:"dns_direct"`
+	DNSDirectServer    string          `json:"dns_direct_server"`
+	DNSTimeout         int             `json:"dns_timeout"`
+	Tunnels            []Tunnel        `json:"tunnels"`
+	ReverseTunnels     []ReverseTunnel `json:"reverse_tunnels"`
+	profile            string
+}
 /**
-  Simple getter for server addr
+  Simple getter for server addr, an ipv6 server is put in brackets
 **/
 func (s ServerInfo) GetServerAddr() string {
-	return s.Server + ":" + strconv.Itoa(s.ServerPort)
+	return net.JoinHostPort(strings.Trim(s.Server, "[]"), strconv.Itoa(s.ServerPort))
 }
 /**
-  Simple getter for local addr
+  Simple getter for local addr, it is the first of listen addrs
 **/
 func (s ServerInfo) GetLocalAddr() string {
-	return "127.0.0.1:" + strconv.Itoa(s.LocalPort)
+	return s.GetListenAddrs()[0]
+}
+/**
+  Addrs for user applications
+  Empty local addr means loopback of both ipv4 and ipv6
+**/
+func (s ServerInfo) GetListenAddrs() []string {
+	port := strconv.Itoa(s.LocalPort)
+	if s.LocalAddr == "" {
+		return []string{net.JoinHostPort("127.0.0.1", port), net.JoinHostPort("::1", port)}
+	}
+	return []string{net.JoinHostPort(strings.Trim(s.LocalAddr, "[]"), port)}
 }
 /**
   Simple getter for UserName
@@ -44,4 +115,155 @@ func (s ServerInfo) GetPassword() string {
 **/
 func (s ServerInfo)GetTimeOut()int{
 	return s.Timeout
-}
\ No newline at end of file
+}
+/**
+	 Timeouts of connections, timeout is used for connecting
+	 Handshake and idle timeouts are default when they are 0 and disabled when they are negative
+	 Max lifetime 0 means unlimited
+**/
+func (s ServerInfo) GetTimeouts() Core.Timeouts {
+	handshake, idle := s.HandshakeTimeout, s.IdleTimeout
+	if handshake == 0 {
+		handshake = Core.DefaultHandshakeTimeout
+	}
+	if idle == 0 {
+		idle = Core.DefaultIdleTimeout
+	}
+	return Core.NewTimeouts(s.Timeout, handshake, idle, s.MaxLifetime)
+}
+/**
+	 Transport options, it must be the same transport as server proxy
+	 Http host and tls server name are server when transport host is empty
+	 Transport proxy is an upstream http proxy for connecting to server proxy
+	 Tls ca is a pem bundle and tls pin is sha256 of server public key, they verify server proxy of tls transport
+**/
+func (s ServerInfo) GetTransportConfig() Core.TransportConfig {
+	host := s.TransportHost
+	if host == "" {
+		host = s.Server
+	}
+	return Core.TransportConfig{
+		Name:     s.Transport,
+		Path:     s.TransportPath,
+		Host:     host,
+		Proxy:    s.TransportProxy,
+		CAFile:   s.TLSCA,
+		Pin:      s.TLSPin,
+		Insecure: s.TLSInsecure,
+	}
+}
+/**
+	 Simple getter for drain timeout, 30 seconds is default
+**/
+func (s ServerInfo) GetDrainTimeout() time.Duration {
+	if s.DrainTimeout == 0 {
+		return 30 * time.Second
+	}
+	return time.Duration(s.DrainTimeout) * time.Second
+}
+/**
+	 Simple getter for heartbeat interval
+**/
+func (s ServerInfo) GetHeartBeatInterval() time.Duration {
+	if s.HeartBeatInterval <= 0 {
+		return Core.DefaultHeartBeatInterval * time.Second
+	}
+	return time.Duration(s.HeartBeatInterval) * time.Second
+}
+/**
+	 Simple getter for heartbeat miss count
+**/
+func (s ServerInfo) GetHeartBeatMissCount() int {
+	if s.HeartBeatMissCount <= 0 {
+		return Core.DefaultHeartBeatMissCount
+	}
+	return s.HeartBeatMissCount
+}
+/**
+  Simple getter for dashboard addr, empty means no dashboard
+**/
+func (s ServerInfo) GetDashboardAddr() string {
+	if s.DashboardPort == 0 {
+		return ""
+	}
+	return "127.0.0.1:" + strconv.Itoa(s.DashboardPort)
+}
+/**
+  Simple getter for dns listener addr, empty means no dns forwarder
+**/
+func (s ServerInfo) GetDNSAddr() string {
+	if s.DNSPort == 0 {
+		return ""
+	}
+	return "127.0.0.1:" + strconv.Itoa(s.DNSPort)
+}
+/**
+  Simple getter for dns timeout, 5 seconds is default
+**/
+func (s ServerInfo) GetDNSTimeout() time.Duration {
+	if s.DNSTimeout <= 0 {
+		return 5 * time.Second
+	}
+	return time.Duration(s.DNSTimeout) * time.Second
+}
+/**
+  Simple getter for routing mode, global is default
+**/
+func (s ServerInfo) GetMode() string {
+	if s.Mode == "" {
+		return ModeGlobal
+	}
+	return s.Mode
+}
+/**
+  Simple getter for current profile name
+**/
+func (s ServerInfo) GetProfile() string {
+	if s.profile == "" {
+		return DefaultProfile
+	}
+	return s.profile
+}
+/**
+  All profiles, the default one is made from top level fields
+  until the first switch copies it into profiles
+**/
+func (s ServerInfo) GetProfiles() []Profile {
+	for _, profile := range s.Profiles {
+		if profile.Name == DefaultProfile {
+			return s.Profiles
+		}
+	}
+	profiles := []Profile{{
+		Name:       DefaultProfile,
+		Server:     s.Server,
+		ServerPort: s.ServerPort,
+		Password:   s.Password,
+		UserName:   s.UserName,
+	}}
+	return append(profiles, s.Profiles...)
+}
+/**
+  Check the mode is one of known routing modes
+**/
+func IsValidMode(mode string) bool {
+	return mode == ModeGlobal || mode == ModeDirect || mode == ModeBypassLan
+}
+/**
+  Return a copy which uses server, user name and password from given profile
+  The default profile is kept in profiles so that it can be switched back
+**/
+func (s ServerInfo) WithProfile(name string) (ServerInfo, error) {
+	for _, profile := range s.GetProfiles() {
+		if profile.Name == name {
+			s.Profiles = s.GetProfiles()
+			s.Server = profile.Server
+			s.ServerPort = profile.ServerPort
+			s.Password = profile.Password
+			s.UserName = profile.UserName
+			s.profile = name
+			return s, nil
+		}
+	}
+	return s, errors.New("profile " + name + " does not exist")
+}
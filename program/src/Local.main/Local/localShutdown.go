@@ -0,0 +1,93 @@
+/**
+  Author: JiaCheng Yang && Wenkai Zheng
+  This file is used for shutting down local proxy gracefully
+  It stops accepting, waits for running connections and closes the session
+**/
+package Local
+
+import (
+	"Core"
+	"Logging"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+/**
+  Exit codes of local proxy
+**/
+const (
+	ExitOK      = 0
+	ExitError   = 1
+	ExitAborted = 2
+)
+
+/**
+  How often drain checks running connections
+**/
+const drainInterval = 100 * time.Millisecond
+
+/**
+  This function waits for SIGINT or SIGTERM in another go routine
+  And closes the listeners so that Listen returns, dns forwarder stops as well
+**/
+func (c *Client) WaitForSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		Logging.NormalLogger.Println("receive", sig, "stop accepting new connections")
+		atomic.StoreInt32(&c.stopping, 1)
+		c.mutex.Lock()
+		forwarder := c.dns
+		c.mutex.Unlock()
+		if forwarder != nil {
+			forwarder.close()
+		}
+		c.closeListeners()
+		// a second signal does not wait anymore
+		sig = <-signals
+		Logging.NormalLogger.Println("receive", sig, "again, exit now")
+		os.Exit(ExitAborted)
+	}()
+}
+
+/**
+  This function lets running connections finish until drain timeout
+  Then the rest are aborted and session with server proxy is closed
+  It returns the exit code for main
+**/
+func (c *Client) Shutdown() int {
+	code := ExitOK
+	deadline := time.Now().Add(c.GetInfo().GetDrainTimeout())
+	for {
+		count := len(c.getConnections())
+		if count == 0 {
+			Logging.NormalLogger.Println("all connections are drained")
+			break
+		}
+		if time.Now().After(deadline) {
+			Logging.NormalLogger.Println("drain timeout,", count, "connections are aborted")
+			for _, connection := range c.getConnections() {
+				connection.handler.Close(Core.CloseShutdown)
+			}
+			code = ExitAborted
+			break
+		}
+		time.Sleep(drainInterval)
+	}
+	c.mutex.Lock()
+	controlTcpConn := c.controlTcpConn
+	c.controlTcpConn = nil
+	c.mutex.Unlock()
+	if controlTcpConn != nil {
+		if err := controlTcpConn.Close(); err != nil {
+			Logging.ErrorLogger.Println(err)
+		}
+	}
+	c.status.setState(StateDisconnected, nil)
+	Logging.NormalLogger.Println("local proxy is stopped")
+	return code
+}
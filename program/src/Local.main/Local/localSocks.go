@@ -0,0 +1,96 @@
+/**
+  Author: JiaCheng Yang && Wenkai Zheng
+  This file is used for the socks5 part between user application and local proxy
+  Local proxy finishes method negotiation by itself and reads the request
+  So it knows the target and can give a reply when server proxy is gone
+**/
+package Local
+
+import (
+	"Core"
+	"errors"
+	"net"
+	"strconv"
+)
+
+/**
+  Server proxy replied a failure, the reply is given to user application
+**/
+type socksError struct {
+	reply byte
+}
+
+func (e *socksError) Error() string {
+	return "server proxy replied " + strconv.Itoa(int(e.reply))
+}
+
+/**
+  This function reads VER NMETHODS METHODS from user application
+  And replies that no authentication is needed
+**/
+func acceptSocksGreeting(localTcpConn net.Conn) error {
+	header := make([]byte, 2)
+	if _, err := Core.ReadAll(header, localTcpConn, 2); err != nil {
+		return err
+	}
+	if header[0] != Core.SocksVersion {
+		return errors.New("The protocol setting is not proxy5")
+	}
+	methods := make([]byte, int(header[1]))
+	if len(methods) > 0 {
+		if _, err := Core.ReadAll(methods, localTcpConn, len(methods)); err != nil {
+			return err
+		}
+	}
+	_, err := Core.WriteAll([]byte{Core.SocksVersion, Core.SocksNoAuth}, localTcpConn, 2)
+	return err
+}
+
+/**
+	+----+-----+-------+------+----------+----------+
+	|VER | CMD |  RSV  | ATYP | DST.ADDR | DST.PORT |
+	+----+-----+-------+------+----------+----------+
+	| 1  |  1  | X'00' |  1   | Variable |    2     |
+	+----+-----+-------+------+----------+----------+
+  This function reads the whole request from user application
+  It returns raw request bytes (to be sent to server proxy) and target host:port
+**/
+func readSocksRequest(localTcpConn net.Conn) ([]byte, string, error) {
+	header := make([]byte, 3)
+	if _, err := Core.ReadAll(header, localTcpConn, 3); err != nil {
+		return nil, "", err
+	}
+	target, err := Core.ReadSocksAddr(localTcpConn, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	request := append(header, target.Bytes()...)
+	return request, target.String(), nil
+}
+
+/**
+  This function gives a reply with empty bind address to user application
+**/
+func writeSocksReply(localTcpConn net.Conn, reply byte) error {
+	response := []byte{Core.SocksVersion, reply, 0x00, Core.IpV4, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+	_, err := Core.WriteAll(response, localTcpConn, len(response))
+	return err
+}
+
+/**
+  Private and loopback targets are connected directly in bypass lan mode
+**/
+func isLanTarget(target string) bool {
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast()
+}
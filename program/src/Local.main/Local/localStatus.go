@@ -0,0 +1,102 @@
+/**
+  Author: JiaCheng Yang && Wenkai Zheng
+  This file is used for recording status of local proxy
+  Dashboard reads connection state and visited sites from here
+**/
+package Local
+
+import (
+	"sync"
+	"time"
+)
+
+/**
+  States of the connection between local proxy and server proxy
+**/
+const (
+	StateConnecting   = "connecting"
+	StateConnected    = "connected"
+	StateDisconnected = "disconnected"
+)
+
+/**
+  Only the newest visited sites are kept
+**/
+const HistorySize = 200
+
+/**
+  One visited site
+**/
+type HistoryEntry struct {
+	Target string    `json:"target"`
+	Route  string    `json:"route"`
+	Time   time.Time `json:"time"`
+}
+
+/**
+  Status struct is shared between connections and dashboard
+  So every field is guarded by mutex
+**/
+type Status struct {
+	mutex     sync.Mutex
+	state     string
+	since     time.Time
+	lastError string
+	history   []HistoryEntry
+}
+
+/**
+  Simple constructor for status
+**/
+func newStatus() *Status {
+	return &Status{state: StateDisconnected, since: time.Now()}
+}
+
+/**
+  Change connection state, err can be nil
+**/
+func (s *Status) setState(state string, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.state != state {
+		s.state = state
+		s.since = time.Now()
+	}
+	if err != nil {
+		s.lastError = err.Error()
+	} else if state == StateConnected {
+		s.lastError = ""
+	}
+}
+
+/**
+  Simple getter for state, the time it starts and the last error
+**/
+func (s *Status) getState() (string, time.Time, string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.state, s.since, s.lastError
+}
+
+/**
+  Add a visited site into history
+**/
+func (s *Status) addHistory(target, route string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.history = append(s.history, HistoryEntry{Target: target, Route: route, Time: time.Now()})
+	if len(s.history) > HistorySize {
+		s.history = s.history[len(s.history)-HistorySize:]
+	}
+}
+
+/**
+  Copy of history, newest site is the last one
+**/
+func (s *Status) getHistory() []HistoryEntry {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	history := make([]HistoryEntry, len(s.history))
+	copy(history, s.history)
+	return history
+}
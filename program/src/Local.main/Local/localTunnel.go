@@ -0,0 +1,95 @@
+/**
+  Author: JiaCheng Yang && Wenkai Zheng
+  This file is used for static tunnels of local proxy
+  Each tunnel listens on a local port and sends every conn to a fixed target through server proxy
+  So applications without socks5 support (database clients, ssh) can use the encrypted tunnel
+**/
+package Local
+
+import (
+	"Core"
+	"Logging"
+	"net"
+)
+
+/**
+  Route of connections of static tunnels
+**/
+const RouteTunnel = "tunnel"
+
+/**
+  One static tunnel in config file, listen is host:port and target is host:port behind server proxy
+**/
+type Tunnel struct {
+	Listen string `json:"listen"`
+	Target string `json:"target"`
+}
+
+/**
+  Start listening on all tunnels, a wrong tunnel stops the ones which are started already
+**/
+func (c *Client) StartTunnels() error {
+	var listeners []*net.TCPListener
+	closeAll := func() {
+		for _, listener := range listeners {
+			_ = listener.Close()
+		}
+	}
+	requests := make([][]byte, 0, len(c.GetInfo().Tunnels))
+	for _, tunnel := range c.GetInfo().Tunnels {
+		target, err := Core.NewSocksAddr(tunnel.Target)
+		if err != nil {
+			closeAll()
+			return err
+		}
+		tcpAddr, err := net.ResolveTCPAddr("tcp", tunnel.Listen)
+		var tcpListener *net.TCPListener
+		if err == nil {
+			tcpListener, err = net.ListenTCP("tcp", tcpAddr)
+		}
+		if err != nil {
+			closeAll()
+			return err
+		}
+		listeners = append(listeners, tcpListener)
+		requests = append(requests, append([]byte{Core.SocksVersion, Core.SocksConnect, 0x00}, target.Bytes()...))
+		Logging.NormalLogger.Println("tunnel", tunnel.Listen, "goes to", target)
+	}
+	c.mutex.Lock()
+	c.tunnels = listeners
+	c.mutex.Unlock()
+	for i, tcpListener := range listeners {
+		go c.acceptTunnel(tcpListener, requests[i], c.GetInfo().Tunnels[i].Target)
+	}
+	return nil
+}
+
+/**
+  Accept conns of one tunnel until its listener is closed
+**/
+func (c *Client) acceptTunnel(tcpListener *net.TCPListener, request []byte, target string) {
+	for {
+		localTcpConn, err := tcpListener.AcceptTCP()
+		if err != nil {
+			return
+		}
+		go c.handleTunnel(localTcpConn, request, target)
+	}
+}
+
+/**
+  The request is the same for every conn of a tunnel, so there is nothing to read from the application
+  A conn which can not reach the target is closed, there is no socks5 reply to tell why
+**/
+func (c *Client) handleTunnel(localTcpConn net.Conn, request []byte, target string) {
+	c.status.addHistory(target, RouteTunnel)
+	serverTcpConn, table, err := c.connectServer(request)
+	if err != nil {
+		Logging.NormalLogger.Println("could not connect tunnel to", target)
+		Logging.ErrorLogger.Println(err)
+		_ = localTcpConn.Close()
+		return
+	}
+	Logging.NormalLogger.Println("accepted a connection to", target, "by", RouteTunnel)
+	c.relay(localTcpConn, serverTcpConn, table, target, RouteTunnel)
+}
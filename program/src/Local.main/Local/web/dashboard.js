@@ -0,0 +1,109 @@
+// last bytes of every connection, used for throughput
+var lastBytes = {};
+var lastTime = 0;
+
+function text(value) {
+  return document.createTextNode(value === undefined ? "" : String(value));
+}
+
+function row(cells) {
+  var tr = document.createElement("tr");
+  cells.forEach(function (cell) {
+    var td = document.createElement("td");
+    td.appendChild(text(cell));
+    tr.appendChild(td);
+  });
+  return tr;
+}
+
+function fill(id, rows) {
+  var body = document.getElementById(id);
+  while (body.firstChild) {
+    body.removeChild(body.firstChild);
+  }
+  rows.forEach(function (r) { body.appendChild(r); });
+}
+
+function options(id, values, selected) {
+  var select = document.getElementById(id);
+  if (select.options.length === values.length) {
+    return;
+  }
+  while (select.firstChild) {
+    select.removeChild(select.firstChild);
+  }
+  values.forEach(function (value) {
+    var option = document.createElement("option");
+    option.value = value;
+    option.appendChild(text(value));
+    option.selected = value === selected;
+    select.appendChild(option);
+  });
+}
+
+function size(bytes) {
+  if (bytes > 1048576) {
+    return (bytes / 1048576).toFixed(1) + " MB";
+  }
+  if (bytes > 1024) {
+    return (bytes / 1024).toFixed(1) + " KB";
+  }
+  return bytes + " B";
+}
+
+function get(path) {
+  return fetch(path).then(function (response) { return response.json(); });
+}
+
+function post(path) {
+  return fetch(path, {method: "POST", headers: {"X-Requested-With": "dashboard"}})
+    .then(function (response) { return response.json(); })
+    .then(function (result) {
+      if (result.error) {
+        alert(result.error);
+      }
+      refresh();
+    });
+}
+
+function refresh() {
+  get("/api/status").then(function (status) {
+    var state = document.getElementById("state");
+    state.className = status.state;
+    state.textContent = status.state + " (" + status.profile + ", " + status.server + ")";
+    document.getElementById("since").textContent = new Date(status.since).toLocaleString();
+    document.getElementById("error").textContent = status.last_error;
+    document.getElementById("local").textContent = status.local;
+    document.getElementById("liveness").textContent = status.liveness;
+    document.getElementById("rtt").textContent = status.rtt_ms.toFixed(1) + " ms (average " + status.smoothed_rtt_ms.toFixed(1) + " ms)";
+    options("profile", status.profiles, status.profile);
+    options("mode", status.modes, status.mode);
+  });
+  get("/api/connections").then(function (connections) {
+    var now = Date.now();
+    var seconds = lastTime === 0 ? 0 : (now - lastTime) / 1000;
+    var bytes = {};
+    fill("connections", connections.map(function (c) {
+      var total = c.upload_bytes + c.download_bytes;
+      var rate = seconds > 0 && lastBytes[c.id] !== undefined ? (total - lastBytes[c.id]) / seconds : 0;
+      bytes[c.id] = total;
+      return row([c.id, c.target, c.route, size(c.upload_bytes), size(c.download_bytes), size(Math.round(rate)) + "/s"]);
+    }));
+    lastBytes = bytes;
+    lastTime = now;
+  });
+  get("/api/history").then(function (history) {
+    fill("history", history.reverse().map(function (h) {
+      return row([new Date(h.time).toLocaleString(), h.target, h.route]);
+    }));
+  });
+}
+
+document.getElementById("switchProfile").onclick = function () {
+  post("/api/profile?name=" + encodeURIComponent(document.getElementById("profile").value));
+};
+document.getElementById("switchMode").onclick = function () {
+  post("/api/mode?mode=" + encodeURIComponent(document.getElementById("mode").value));
+};
+refresh();
+setInterval(refresh, 1000);
@@ -0,0 +1,404 @@
+/**
+  Author: JiaCheng Yang && Wenkai Zheng
+  This file is used for resolving domain names for server proxy
+  Names in hosts file are answered first, then the cache, then upstream dns servers in order
+  Answers are cached for their ttl, names which do not exist are cached for negative ttl
+**/
+package Resolver
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**
+  Address preferences
+  Prefer ipv4 or ipv6 puts those addresses first, only ipv4 or ipv6 never asks for the other one
+**/
+const (
+	PreferIPv4 = "ipv4"
+	PreferIPv6 = "ipv6"
+	OnlyIPv4   = "ipv4_only"
+	OnlyIPv6   = "ipv6_only"
+)
+
+var ErrNotFound = errors.New("no such host")
+var errNoUpstream = errors.New("no dns upstream answered")
+
+/**
+  Config of resolver
+  Servers are upstreams, name servers in /etc/resolv.conf are used when it is empty
+  Ca file verifies dns over https and dns over tls upstreams, system roots are used when it is empty
+  Timeout is for one upstream, the next upstream is asked after it
+  Cache size is the max number of cached answers, 0 means no cache
+  Negative ttl is the max time a missing name is cached, max ttl is the max time of an answer
+**/
+type Config struct {
+	Servers     []string
+	CAFile      string
+	Timeout     time.Duration
+	Prefer      string
+	HostsPath   string
+	CacheSize   int
+	NegativeTTL time.Duration
+	MaxTTL      time.Duration
+}
+
+/**
+  One cached answer of a name and a type, empty addresses mean the name has no such address
+**/
+type cacheEntry struct {
+	ips     []net.IP
+	expires time.Time
+}
+
+/**
+  Resolver is shared by all sessions
+**/
+type Resolver struct {
+	upstreams   []upstream
+	timeout     time.Duration
+	prefer      string
+	cacheSize   int
+	negativeTTL time.Duration
+	maxTTL      time.Duration
+	hosts       map[string][]net.IP
+	mutex       sync.Mutex
+	cache       map[string]*cacheEntry
+}
+
+/**
+  Simple constructor for resolver, it fails on a wrong upstream or hosts file
+**/
+func NewResolver(config Config) (*Resolver, error) {
+	r := &Resolver{
+		timeout:     config.Timeout,
+		prefer:      config.Prefer,
+		cacheSize:   config.CacheSize,
+		negativeTTL: config.NegativeTTL,
+		maxTTL:      config.MaxTTL,
+		hosts:       make(map[string][]net.IP),
+		cache:       make(map[string]*cacheEntry),
+	}
+	if r.timeout <= 0 {
+		r.timeout = 5 * time.Second
+	}
+	switch r.prefer {
+	case "":
+		r.prefer = PreferIPv4
+	case PreferIPv4, PreferIPv6, OnlyIPv4, OnlyIPv6:
+	default:
+		return nil, errors.New("unknown dns preference " + r.prefer)
+	}
+	servers := config.Servers
+	if len(servers) == 0 {
+		servers = systemServers()
+	}
+	if len(servers) == 0 {
+		servers = []string{"127.0.0.1"}
+	}
+	tlsConfig, err := newTLSConfig(config.CAFile)
+	if err != nil {
+		return nil, err
+	}
+	for _, server := range servers {
+		item, err := newUpstream(server, tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		r.upstreams = append(r.upstreams, item)
+	}
+	if config.HostsPath != "" {
+		if err := r.loadHosts(config.HostsPath); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+/**
+  Hosts file has an address and names in each line, # starts a comment
+  A missing hosts file is the same as an empty one
+**/
+func (r *Resolver) loadHosts(path string) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if index := strings.Index(line, "#"); index >= 0 {
+			line = line[:index]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			return errors.New("wrong address " + fields[0] + " in " + path)
+		}
+		for _, name := range fields[1:] {
+			name = normalize(name)
+			r.hosts[name] = append(r.hosts[name], ip)
+		}
+	}
+	return scanner.Err()
+}
+
+func normalize(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+/**
+  Return the first address of a name by preference
+**/
+func (r *Resolver) LookupIP(name string) (net.IP, error) {
+	ips, err := r.Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	return ips[0], nil
+}
+
+/**
+  Return all addresses of a name, preferred family first
+  Both families are asked at the same time
+**/
+func (r *Resolver) Lookup(name string) ([]net.IP, error) {
+	if ip := net.ParseIP(name); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	name = normalize(name)
+	if ips, ok := r.hosts[name]; ok {
+		if ips = r.order(ips); len(ips) > 0 {
+			return ips, nil
+		}
+	}
+	types := r.types()
+	results := make([][]net.IP, len(types))
+	errs := make([]error, len(types))
+	var group sync.WaitGroup
+	for i, qtype := range types {
+		group.Add(1)
+		go func(i int, qtype uint16) {
+			defer group.Done()
+			results[i], errs[i] = r.lookupType(name, qtype)
+		}(i, qtype)
+	}
+	group.Wait()
+	var ips []net.IP
+	for _, result := range results {
+		ips = append(ips, result...)
+	}
+	if len(ips) > 0 {
+		return ips, nil
+	}
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, ErrNotFound
+}
+
+/**
+  Types to ask, preferred first
+**/
+func (r *Resolver) types() []uint16 {
+	switch r.prefer {
+	case OnlyIPv4:
+		return []uint16{TypeA}
+	case OnlyIPv6:
+		return []uint16{TypeAAAA}
+	case PreferIPv6:
+		return []uint16{TypeAAAA, TypeA}
+	}
+	return []uint16{TypeA, TypeAAAA}
+}
+
+/**
+  Addresses from hosts file in the same order as answers
+**/
+func (r *Resolver) order(ips []net.IP) []net.IP {
+	ordered := []net.IP{}
+	for _, qtype := range r.types() {
+		for _, ip := range ips {
+			if (ip.To4() != nil) == (qtype == TypeA) {
+				ordered = append(ordered, ip)
+			}
+		}
+	}
+	return ordered
+}
+
+/**
+  Addresses of one type from cache or upstreams
+  A name which does not exist is an empty answer, so it is cached as well
+**/
+func (r *Resolver) lookupType(name string, qtype uint16) ([]net.IP, error) {
+	key := cacheKey(name, qtype)
+	if ips, ok := r.fromCache(key); ok {
+		return ips, nil
+	}
+	ips, ttl, err := r.query(name, qtype)
+	if err != nil {
+		return nil, err
+	}
+	r.toCache(key, ips, ttl)
+	return ips, nil
+}
+
+func cacheKey(name string, qtype uint16) string {
+	if qtype == TypeAAAA {
+		return "AAAA " + name
+	}
+	return "A " + name
+}
+
+/**
+  Ask upstreams in order until one gives an answer
+  Server failures and timeouts go to the next upstream, a missing name does not
+**/
+func (r *Resolver) query(name string, qtype uint16) ([]net.IP, time.Duration, error) {
+	id, query, err := newQuery(name, qtype)
+	if err != nil {
+		return nil, 0, err
+	}
+	lastErr := errNoUpstream
+	for _, item := range r.upstreams {
+		response, err := item.exchange(query, time.Now().Add(r.timeout))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		result, err := parseAnswer(response)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if result.id != id || result.name != name || result.qtype != qtype {
+			lastErr = errMismatch
+			continue
+		}
+		switch result.rcode {
+		case RcodeSuccess:
+			if len(result.ips) > 0 {
+				return result.ips, r.positiveTTL(result.ttl), nil
+			}
+			return nil, r.negative(result), nil
+		case RcodeNameError:
+			return nil, r.negative(result), nil
+		}
+		lastErr = errors.New("dns upstream " + item.String() + " failed to answer " + name)
+	}
+	return nil, 0, lastErr
+}
+
+/**
+  Ttl of addresses, it is not longer than max ttl
+**/
+func (r *Resolver) positiveTTL(ttl uint32) time.Duration {
+	duration := time.Duration(ttl) * time.Second
+	if r.maxTTL > 0 && duration > r.maxTTL {
+		return r.maxTTL
+	}
+	return duration
+}
+
+/**
+  Ttl of a missing name is from soa, and negative ttl without soa
+**/
+func (r *Resolver) negative(result *answer) time.Duration {
+	if !result.hasSOA {
+		return r.negativeTTL
+	}
+	duration := time.Duration(result.ttl) * time.Second
+	if duration > r.negativeTTL {
+		return r.negativeTTL
+	}
+	return duration
+}
+
+/**
+  Cached addresses which are not expired
+**/
+func (r *Resolver) fromCache(key string) ([]net.IP, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	entry, ok := r.cache[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(r.cache, key)
+		return nil, false
+	}
+	return entry.ips, true
+}
+
+/**
+  Put an answer into cache, expired answers are removed when the cache is full
+  When it is still full some answers are removed, map order makes them random
+**/
+func (r *Resolver) toCache(key string, ips []net.IP, ttl time.Duration) {
+	if r.cacheSize <= 0 || ttl <= 0 {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if len(r.cache) >= r.cacheSize {
+		now := time.Now()
+		for old, entry := range r.cache {
+			if now.After(entry.expires) {
+				delete(r.cache, old)
+			}
+		}
+		for old := range r.cache {
+			if len(r.cache) < r.cacheSize {
+				break
+			}
+			delete(r.cache, old)
+		}
+	}
+	r.cache[key] = &cacheEntry{ips: ips, expires: time.Now().Add(ttl)}
+}
+
+/**
+  Send a query from a client to upstreams as it is and return the first response which is not a server failure
+  It is used for queries which are tunneled from local proxy, so any type can be asked
+**/
+func (r *Resolver) Exchange(query []byte) ([]byte, error) {
+	if _, _, err := ParseQuestion(query); err != nil {
+		return nil, err
+	}
+	lastErr := errNoUpstream
+	for _, item := range r.upstreams {
+		response, err := item.exchange(query, time.Now().Add(r.timeout))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if len(response) < headerLength || int(response[3]&0xF) == RcodeServerFailure {
+			lastErr = errors.New("dns upstream " + item.String() + " failed to answer")
+			continue
+		}
+		// the client matches by id as well, but a response of another query must not reach it
+		if response[0] != query[0] || response[1] != query[1] {
+			lastErr = errMismatch
+			continue
+		}
+		return response, nil
+	}
+	return nil, lastErr
+}
@@ -0,0 +1,164 @@
+/**
+  Author: JiaCheng Yang && Wenkai Zheng
+  This file is used for encrypted upstream dns servers of resolver
+  Dns over https (RFC 8484) is written as https://host/path, queries are posted as application/dns-message
+  Dns over tls (RFC 7858) is written as tls://host:port, port 853 is default
+  Connections are kept open and used again, so most queries do not need a new tls handshake
+**/
+package Resolver
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const dnsMessageType = "application/dns-message"
+
+/**
+  Max idle tls conns of one dns over tls upstream
+**/
+const maxIdleConns = 4
+
+/**
+  Idle conns are closed by servers after some time, so they are not used after this time
+**/
+const idleTimeout = 30 * time.Second
+
+type httpsUpstream struct {
+	url    string
+	client *http.Client
+}
+
+/**
+  Http client keeps connections open, http/2 is used when the server supports it
+**/
+func newHTTPSUpstream(address *url.URL, tlsConfig *tls.Config) *httpsUpstream {
+	transport := &http.Transport{
+		TLSClientConfig:     tlsConfig,
+		MaxIdleConnsPerHost: maxIdleConns,
+		IdleConnTimeout:     idleTimeout,
+		ForceAttemptHTTP2:   true,
+	}
+	return &httpsUpstream{url: address.String(), client: &http.Client{Transport: transport}}
+}
+
+func (u *httpsUpstream) String() string {
+	return u.url
+}
+
+func (u *httpsUpstream) exchange(query []byte, deadline time.Time) ([]byte, error) {
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, u.url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", dnsMessageType)
+	request.Header.Set("Accept", dnsMessageType)
+	response, err := u.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, errors.New("dns upstream " + u.url + " replied " + response.Status)
+	}
+	message, err := ioutil.ReadAll(io.LimitReader(response.Body, 65535))
+	if err != nil {
+		return nil, err
+	}
+	if len(message) < headerLength || message[0] != query[0] || message[1] != query[1] {
+		return nil, errMismatch
+	}
+	return message, nil
+}
+
+/**
+  Idle conns wait in a channel, a conn is used by one query at a time
+**/
+type tlsUpstream struct {
+	address   string
+	tlsConfig *tls.Config
+	idle      chan *idleConn
+}
+
+type idleConn struct {
+	conn  *tls.Conn
+	since time.Time
+}
+
+func newTLSUpstream(address string, tlsConfig *tls.Config) *tlsUpstream {
+	host, _, _ := net.SplitHostPort(address)
+	config := tlsConfig.Clone()
+	if config.ServerName == "" {
+		config.ServerName = host
+	}
+	return &tlsUpstream{address: address, tlsConfig: config, idle: make(chan *idleConn, maxIdleConns)}
+}
+
+func (u *tlsUpstream) String() string {
+	return "tls://" + u.address
+}
+
+/**
+  A kept conn can be closed by server already, then the query is sent again on a new conn
+**/
+func (u *tlsUpstream) exchange(query []byte, deadline time.Time) ([]byte, error) {
+	for {
+		conn, reused, err := u.get(deadline)
+		if err != nil {
+			return nil, err
+		}
+		if err = conn.SetDeadline(deadline); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		response, err := exchangeStream(conn, query)
+		if err == nil {
+			u.put(conn)
+			return response, nil
+		}
+		_ = conn.Close()
+		if !reused || time.Now().After(deadline) {
+			return nil, err
+		}
+	}
+}
+
+/**
+  Take an idle conn which is not too old, or make a new one
+**/
+func (u *tlsUpstream) get(deadline time.Time) (*tls.Conn, bool, error) {
+	for {
+		select {
+		case item := <-u.idle:
+			if time.Since(item.since) < idleTimeout {
+				return item.conn, true, nil
+			}
+			_ = item.conn.Close()
+		default:
+			dialer := &net.Dialer{Deadline: deadline}
+			conn, err := tls.DialWithDialer(dialer, "tcp", u.address, u.tlsConfig)
+			return conn, false, err
+		}
+	}
+}
+
+/**
+  Keep a conn for next query, it is closed when there are enough idle conns
+**/
+func (u *tlsUpstream) put(conn *tls.Conn) {
+	select {
+	case u.idle <- &idleConn{conn: conn, since: time.Now()}:
+	default:
+		_ = conn.Close()
+	}
+}
@@ -0,0 +1,162 @@
+package Resolver
+
+/**
+  Author: JiaCheng Yang && Wenkai Zheng
+  Tests of encrypted upstreams, dns over https against an httptest tls server and dns over tls against a tls listener
+  Both use the certificate of httptest, it is given to resolver as ca file
+**/
+import (
+	"crypto/tls"
+	"encoding/pem"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+/**
+  Write the certificate of server into a ca file
+**/
+func writeCAFile(t *testing.T, server *httptest.Server) string {
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	content := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(path, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+/**
+  Queries are posted as application/dns-message and the response is the body
+**/
+func TestLookupHTTPS(t *testing.T) {
+	var requests int32
+	answer := addresses(60, net.IPv4(10, 0, 2, 1))
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if request.Method != http.MethodPost || request.URL.Path != "/dns-query" || request.Header.Get("Content-Type") != dnsMessageType {
+			http.Error(writer, "bad request", http.StatusBadRequest)
+			return
+		}
+		query, err := io.ReadAll(request.Body)
+		if err != nil {
+			return
+		}
+		writer.Header().Set("Content-Type", dnsMessageType)
+		_, _ = writer.Write(answer(query, true))
+	}))
+	// the lookup without ca file fails its handshake on purpose
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	server.StartTLS()
+	defer server.Close()
+
+	r := newTestResolver(t, Config{Servers: []string{server.URL + "/dns-query"}, CAFile: writeCAFile(t, server)})
+	for i := 0; i < 2; i++ {
+		ips, err := r.Lookup("doh.example")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ips) != 1 || !ips[0].Equal(net.IPv4(10, 0, 2, 1)) {
+			t.Fatalf("got %v", ips)
+		}
+	}
+	if atomic.LoadInt32(&requests) != 2 {
+		t.Fatalf("%d requests, want 2", requests)
+	}
+
+	// without the ca file the certificate of httptest is not trusted
+	r = newTestResolver(t, Config{Servers: []string{server.URL + "/dns-query"}})
+	if _, err := r.Lookup("doh.example"); err == nil {
+		t.Fatal("lookup trusted an unknown certificate")
+	}
+}
+
+/**
+  A non 200 status is an error of that upstream
+**/
+func TestLookupHTTPSStatus(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		http.Error(writer, "gone", http.StatusGone)
+	}))
+	defer server.Close()
+	r := newTestResolver(t, Config{Servers: []string{server.URL + "/dns-query"}, CAFile: writeCAFile(t, server)})
+	if _, err := r.Lookup("doh.example"); err == nil {
+		t.Fatal("lookup took a response with status 410")
+	}
+}
+
+/**
+  Dns over tls server with the certificate of an httptest server, it counts accepted conns
+  A conn is closed after limit queries when limit is above 0
+**/
+func newTLSStandIn(t *testing.T, limit int) (string, string, *int32) {
+	certificate := httptest.NewTLSServer(http.NotFoundHandler())
+	t.Cleanup(certificate.Close)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: certificate.TLS.Certificates})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	var accepted int32
+	answer := addresses(60, net.IPv4(10, 0, 3, 1))
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			queries := 0
+			go serveStream(conn, func(query []byte) []byte {
+				queries++
+				if limit > 0 && queries > limit {
+					// server closes an idle conn, the query is not answered
+					return nil
+				}
+				return answer(query, true)
+			})
+		}
+	}()
+	return "tls://" + listener.Addr().String(), writeCAFile(t, certificate), &accepted
+}
+
+/**
+  Queries without cache share one tls conn
+**/
+func TestLookupTLSReusesConn(t *testing.T) {
+	address, caFile, accepted := newTLSStandIn(t, 0)
+	r := newTestResolver(t, Config{Servers: []string{address}, CAFile: caFile})
+	for i := 0; i < 5; i++ {
+		ips, err := r.Lookup("dot.example")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ips) != 1 || !ips[0].Equal(net.IPv4(10, 0, 3, 1)) {
+			t.Fatalf("got %v", ips)
+		}
+	}
+	if got := atomic.LoadInt32(accepted); got != 1 {
+		t.Fatalf("%d tls conns for 5 queries, want 1", got)
+	}
+}
+
+/**
+  A kept conn which is closed by server is not an error, the query is sent again on a new conn
+**/
+func TestLookupTLSRetriesClosedConn(t *testing.T) {
+	address, caFile, accepted := newTLSStandIn(t, 1)
+	r := newTestResolver(t, Config{Servers: []string{address}, CAFile: caFile})
+	for i := 0; i < 3; i++ {
+		if _, err := r.Lookup("dot.example"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := atomic.LoadInt32(accepted); got != 3 {
+		t.Fatalf("%d tls conns, want 3", got)
+	}
+}
@@ -0,0 +1,343 @@
+/**
+  Author: JiaCheng Yang && Wenkai Zheng
+  This file is used for dns messages (RFC 1035)
+  Only what resolver needs is here: a query of one question and addresses, ttl and rcode of a response
+**/
+package Resolver
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+)
+
+/**
+	+----+-------+---------+---------+---------+---------+
+	| ID | FLAGS | QDCOUNT | ANCOUNT | NSCOUNT | ARCOUNT |
+	+----+-------+---------+---------+---------+---------+
+	| 2  |   2   |    2    |    2    |    2    |    2    |
+	+----+-------+---------+---------+---------+---------+
+  Header is followed by questions, answers, authorities and additionals
+**/
+const headerLength = 12
+
+/**
+  Record types and class which resolver uses
+**/
+const (
+	TypeA    = 1
+	TypeSOA  = 6
+	TypeAAAA = 28
+	TypeOPT  = 41
+	ClassIN  = 1
+)
+
+/**
+  Response codes
+**/
+const (
+	RcodeSuccess        = 0
+	RcodeServerFailure  = 2
+	RcodeNameError      = 3
+	RcodeNotImplemented = 4
+)
+
+const flagResponse = 0x8000
+const flagTruncated = 0x0200
+const flagRecursion = 0x0100
+const flagAvailable = 0x0080
+
+/**
+  Udp response without edns is at most 512 bytes
+**/
+const udpPayloadSize = 512
+
+/**
+  Udp payload size which is sent in edns, it avoids fragmentation
+**/
+const ednsPayloadSize = 1232
+
+var errMessage = errors.New("wrong dns message")
+var errName = errors.New("wrong domain name")
+
+/**
+  What resolver needs from a response
+  Ttl is the smallest ttl of addresses, or of soa for a response without addresses
+**/
+type answer struct {
+	id        uint16
+	rcode     int
+	truncated bool
+	name      string
+	qtype     uint16
+	ips       []net.IP
+	ttl       uint32
+	hasSOA    bool
+}
+
+/**
+  Make a query with recursion desired and an edns record
+**/
+func newQuery(name string, qtype uint16) (uint16, []byte, error) {
+	var id [2]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return 0, nil, err
+	}
+	message := make([]byte, headerLength, headerLength+len(name)+2+4+11)
+	copy(message, id[:])
+	binary.BigEndian.PutUint16(message[2:], flagRecursion)
+	binary.BigEndian.PutUint16(message[4:], 1)
+	binary.BigEndian.PutUint16(message[10:], 1)
+	message, err := appendName(message, name)
+	if err != nil {
+		return 0, nil, err
+	}
+	message = appendUint16(message, qtype)
+	message = appendUint16(message, ClassIN)
+	// opt record: root name, type, payload size as class, ttl 0 and no data
+	message = append(message, 0)
+	message = appendUint16(message, TypeOPT)
+	message = appendUint16(message, ednsPayloadSize)
+	message = append(message, 0, 0, 0, 0, 0, 0)
+	return binary.BigEndian.Uint16(id[:]), message, nil
+}
+
+func appendUint16(message []byte, value uint16) []byte {
+	return append(message, byte(value>>8), byte(value))
+}
+
+/**
+  Domain name in labels, each label is its length and bytes, the name ends with 0
+**/
+func appendName(message []byte, name string) ([]byte, error) {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" || len(name) > 253 {
+		return nil, errName
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 {
+			return nil, errName
+		}
+		message = append(message, byte(len(label)))
+		message = append(message, label...)
+	}
+	return append(message, 0), nil
+}
+
+/**
+  Read a name at offset, it can be compressed by pointers (two bits 11 and 14 bits of offset)
+  It returns the name and the offset after it
+**/
+func readName(message []byte, offset int) (string, int, error) {
+	var labels []string
+	next := -1
+	for jumps := 0; ; {
+		if offset >= len(message) {
+			return "", 0, errMessage
+		}
+		length := int(message[offset])
+		switch {
+		case length == 0:
+			if next < 0 {
+				next = offset + 1
+			}
+			return strings.Join(labels, "."), next, nil
+		case length&0xC0 == 0xC0:
+			if offset+1 >= len(message) || jumps > 64 {
+				return "", 0, errMessage
+			}
+			if next < 0 {
+				next = offset + 2
+			}
+			offset = int(binary.BigEndian.Uint16(message[offset:]) & 0x3FFF)
+			jumps++
+		case length > 63 || offset+1+length > len(message):
+			return "", 0, errMessage
+		default:
+			labels = append(labels, string(message[offset+1:offset+1+length]))
+			offset += 1 + length
+		}
+	}
+}
+
+/**
+  Parse a response, addresses of the question type are kept
+  Cname records are followed by recursive servers, so addresses are taken from any owner name
+**/
+func parseAnswer(message []byte) (*answer, error) {
+	if len(message) < headerLength {
+		return nil, errMessage
+	}
+	flags := binary.BigEndian.Uint16(message[2:])
+	if flags&flagResponse == 0 {
+		return nil, errMessage
+	}
+	result := &answer{
+		id:        binary.BigEndian.Uint16(message),
+		rcode:     int(flags & 0xF),
+		truncated: flags&flagTruncated != 0,
+	}
+	questions := int(binary.BigEndian.Uint16(message[4:]))
+	answers := int(binary.BigEndian.Uint16(message[6:]))
+	authorities := int(binary.BigEndian.Uint16(message[8:]))
+	if questions != 1 {
+		return nil, errMessage
+	}
+	name, offset, err := readName(message, headerLength)
+	if err != nil || offset+4 > len(message) {
+		return nil, errMessage
+	}
+	result.name = strings.ToLower(name)
+	result.qtype = binary.BigEndian.Uint16(message[offset:])
+	offset += 4
+	var minTTL uint32
+	found := false
+	for i := 0; i < answers+authorities; i++ {
+		_, offset, err = readName(message, offset)
+		if err != nil || offset+10 > len(message) {
+			return nil, errMessage
+		}
+		rtype := binary.BigEndian.Uint16(message[offset:])
+		ttl := binary.BigEndian.Uint32(message[offset+4:])
+		length := int(binary.BigEndian.Uint16(message[offset+8:]))
+		offset += 10
+		if offset+length > len(message) {
+			return nil, errMessage
+		}
+		data := message[offset : offset+length]
+		offset += length
+		switch {
+		case i < answers && rtype == result.qtype && rtype == TypeA && length == net.IPv4len:
+			result.ips = append(result.ips, net.IP(append([]byte(nil), data...)))
+		case i < answers && rtype == result.qtype && rtype == TypeAAAA && length == net.IPv6len:
+			result.ips = append(result.ips, net.IP(append([]byte(nil), data...)))
+		case i >= answers && rtype == TypeSOA && len(result.ips) == 0:
+			// negative answers live for min of soa ttl and soa minimum (RFC 2308)
+			if minimum, ok := soaMinimum(message, offset-length); ok && minimum < ttl {
+				ttl = minimum
+			}
+			result.hasSOA = true
+		default:
+			continue
+		}
+		if !found || ttl < minTTL {
+			minTTL = ttl
+			found = true
+		}
+	}
+	result.ttl = minTTL
+	return result, nil
+}
+
+/**
+  Minimum is the last field of soa data, after two names and four numbers
+**/
+func soaMinimum(message []byte, offset int) (uint32, bool) {
+	_, offset, err := readName(message, offset)
+	if err != nil {
+		return 0, false
+	}
+	_, offset, err = readName(message, offset)
+	if err != nil || offset+20 > len(message) {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(message[offset+16:]), true
+}
+
+/**
+  Name and type of the only question of a query
+**/
+func ParseQuestion(message []byte) (string, uint16, error) {
+	if len(message) < headerLength || binary.BigEndian.Uint16(message[2:])&flagResponse != 0 {
+		return "", 0, errMessage
+	}
+	if binary.BigEndian.Uint16(message[4:]) != 1 {
+		return "", 0, errMessage
+	}
+	name, offset, err := readName(message, headerLength)
+	if err != nil || offset+4 > len(message) {
+		return "", 0, errMessage
+	}
+	return strings.ToLower(name), binary.BigEndian.Uint16(message[offset:]), nil
+}
+
+/**
+  Header and question of a query as a response without records
+**/
+func responseHeader(query []byte, rcode int) ([]byte, error) {
+	_, offset, err := readName(query, headerLength)
+	if err != nil || offset+4 > len(query) {
+		return nil, errMessage
+	}
+	response := append([]byte(nil), query[:offset+4]...)
+	flags := binary.BigEndian.Uint16(query[2:])&flagRecursion | flagResponse | flagAvailable | uint16(rcode)
+	binary.BigEndian.PutUint16(response[2:], flags)
+	binary.BigEndian.PutUint16(response[4:], 1)
+	binary.BigEndian.PutUint16(response[6:], 0)
+	binary.BigEndian.PutUint16(response[8:], 0)
+	binary.BigEndian.PutUint16(response[10:], 0)
+	return response, nil
+}
+
+/**
+  A response which has only an rcode
+**/
+func NewErrorResponse(query []byte, rcode int) ([]byte, error) {
+	return responseHeader(query, rcode)
+}
+
+/**
+  A response with addresses of the question type, other addresses are left out
+**/
+func NewResponse(query []byte, qtype uint16, ips []net.IP, ttl uint32) ([]byte, error) {
+	response, err := responseHeader(query, RcodeSuccess)
+	if err != nil {
+		return nil, err
+	}
+	count := 0
+	for _, ip := range ips {
+		data := ip.To4()
+		if qtype == TypeAAAA {
+			if data != nil {
+				continue
+			}
+			data = ip.To16()
+		}
+		if data == nil || qtype != TypeA && qtype != TypeAAAA {
+			continue
+		}
+		// pointer to the name of question
+		response = append(response, 0xC0, headerLength)
+		response = appendUint16(response, qtype)
+		response = appendUint16(response, ClassIN)
+		response = append(response, byte(ttl>>24), byte(ttl>>16), byte(ttl>>8), byte(ttl))
+		response = appendUint16(response, uint16(len(data)))
+		response = append(response, data...)
+		count++
+	}
+	binary.BigEndian.PutUint16(response[6:], uint16(count))
+	return response, nil
+}
+
+/**
+  A udp response which is too long for the client is cut to header and question with truncated flag
+  The client asks again over tcp
+**/
+func FitUDP(query, response []byte) []byte {
+	limit := udpPayloadSize
+	if len(query) >= headerLength && binary.BigEndian.Uint16(query[10:]) > 0 {
+		limit = ednsPayloadSize
+	}
+	if len(response) <= limit {
+		return response
+	}
+	truncated, err := responseHeader(response, int(response[3]&0xF))
+	if err != nil {
+		return response[:headerLength]
+	}
+	flags := binary.BigEndian.Uint16(response[2:]) | flagTruncated
+	binary.BigEndian.PutUint16(truncated[2:], flags)
+	return truncated
+}
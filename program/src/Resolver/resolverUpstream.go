@@ -0,0 +1,194 @@
+/**
+  Author: JiaCheng Yang && Wenkai Zheng
+  This file is used for upstream dns servers of resolver
+  An upstream is written as udp://host:port, tcp://host:port or host, port 53 is default
+  Encrypted upstreams are https://host/path and tls://host:port
+  A truncated udp response is asked again over tcp
+**/
+package Resolver
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+var errMismatch = errors.New("dns response does not match query")
+
+/**
+  Upstream sends one query and returns the response
+**/
+type upstream interface {
+	exchange(query []byte, deadline time.Time) ([]byte, error)
+	String() string
+}
+
+/**
+  This function makes an upstream from its address
+  Tls config is used by dns over https and dns over tls
+**/
+func newUpstream(address string, tlsConfig *tls.Config) (upstream, error) {
+	scheme := "udp"
+	if index := strings.Index(address, "://"); index >= 0 {
+		scheme = address[:index]
+	}
+	if scheme == "https" {
+		parsed, err := url.Parse(address)
+		if err != nil {
+			return nil, err
+		}
+		return newHTTPSUpstream(parsed, tlsConfig), nil
+	}
+	address = strings.TrimPrefix(address, scheme+"://")
+	port := "53"
+	if scheme == "tls" {
+		port = "853"
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(strings.Trim(address, "[]"), port)
+	}
+	switch scheme {
+	case "udp":
+		return &udpUpstream{address: address}, nil
+	case "tcp":
+		return &tcpUpstream{address: address}, nil
+	case "tls":
+		return newTLSUpstream(address, tlsConfig), nil
+	}
+	return nil, errors.New("unknown dns upstream " + scheme)
+}
+
+/**
+  Tls config of encrypted upstreams, a ca file replaces system roots (for example for a local dns server)
+**/
+func newTLSConfig(caFile string) (*tls.Config, error) {
+	config := &tls.Config{}
+	if caFile == "" {
+		return config, nil
+	}
+	content, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(content) {
+		return nil, errors.New("no certificate in " + caFile)
+	}
+	config.RootCAs = pool
+	return config, nil
+}
+
+/**
+  Name servers of the system in /etc/resolv.conf, they are used when no upstream is configured
+**/
+func systemServers() []string {
+	servers := []string{}
+	file, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return servers
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			servers = append(servers, fields[1])
+		}
+	}
+	return servers
+}
+
+type udpUpstream struct {
+	address string
+}
+
+func (u *udpUpstream) String() string {
+	return "udp://" + u.address
+}
+
+/**
+  Responses with other id are ignored, they can be late responses or spoofed
+**/
+func (u *udpUpstream) exchange(query []byte, deadline time.Time) ([]byte, error) {
+	conn, err := net.DialTimeout("udp", u.address, time.Until(deadline))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err = conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+	if _, err = conn.Write(query); err != nil {
+		return nil, err
+	}
+	buffer := make([]byte, 65535)
+	for {
+		readLength, err := conn.Read(buffer)
+		if err != nil {
+			return nil, err
+		}
+		if readLength >= headerLength && buffer[0] == query[0] && buffer[1] == query[1] {
+			response := buffer[:readLength]
+			if response[2]&(flagTruncated>>8) != 0 {
+				return (&tcpUpstream{address: u.address}).exchange(query, deadline)
+			}
+			return append([]byte(nil), response...), nil
+		}
+	}
+}
+
+type tcpUpstream struct {
+	address string
+}
+
+func (u *tcpUpstream) String() string {
+	return "tcp://" + u.address
+}
+
+/**
+  Over tcp each message has 2 bytes of length before it
+**/
+func (u *tcpUpstream) exchange(query []byte, deadline time.Time) ([]byte, error) {
+	conn, err := net.DialTimeout("tcp", u.address, time.Until(deadline))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err = conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+	return exchangeStream(conn, query)
+}
+
+/**
+  Send a query with length and read a response with length, it is used by all stream upstreams
+**/
+func exchangeStream(conn io.ReadWriter, query []byte) ([]byte, error) {
+	message := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(message, uint16(len(query)))
+	copy(message[2:], query)
+	if _, err := conn.Write(message); err != nil {
+		return nil, err
+	}
+	length := make([]byte, 2)
+	if _, err := io.ReadFull(conn, length); err != nil {
+		return nil, err
+	}
+	response := make([]byte, binary.BigEndian.Uint16(length))
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return nil, err
+	}
+	if len(response) < headerLength || response[0] != query[0] || response[1] != query[1] {
+		return nil, errMismatch
+	}
+	return response, nil
+}
@@ -0,0 +1,369 @@
+package Resolver
+
+/**
+  Author: JiaCheng Yang && Wenkai Zheng
+  Tests of resolver against a stand-in dns server on 127.0.0.1, over udp and tcp on the same port
+**/
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+/**
+  Stand-in dns server, answer makes the response of a query and tcp tells how it came
+  Queries are counted for each transport
+**/
+type standIn struct {
+	udp        *net.UDPConn
+	tcp        *net.TCPListener
+	answer     func(query []byte, tcp bool) []byte
+	udpQueries int32
+	tcpQueries int32
+}
+
+/**
+  Listen on a free udp port and tcp on the same port
+**/
+func newStandIn(t *testing.T, answer func(query []byte, tcp bool) []byte) *standIn {
+	s := &standIn{answer: answer}
+	for i := 0; i < 10 && s.tcp == nil; i++ {
+		udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tcp, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: udp.LocalAddr().(*net.UDPAddr).Port})
+		if err != nil {
+			_ = udp.Close()
+			continue
+		}
+		s.udp, s.tcp = udp, tcp
+	}
+	if s.tcp == nil {
+		t.Fatal("no free port for udp and tcp")
+	}
+	go s.serveUDP()
+	go s.serveTCP()
+	t.Cleanup(func() {
+		_ = s.udp.Close()
+		_ = s.tcp.Close()
+	})
+	return s
+}
+
+func (s *standIn) address() string {
+	return s.udp.LocalAddr().String()
+}
+
+func (s *standIn) serveUDP() {
+	buffer := make([]byte, 65535)
+	for {
+		readLength, addr, err := s.udp.ReadFromUDP(buffer)
+		if err != nil {
+			return
+		}
+		atomic.AddInt32(&s.udpQueries, 1)
+		if response := s.answer(append([]byte(nil), buffer[:readLength]...), false); response != nil {
+			_, _ = s.udp.WriteToUDP(response, addr)
+		}
+	}
+}
+
+/**
+  Each tcp conn can carry many queries
+**/
+func (s *standIn) serveTCP() {
+	for {
+		conn, err := s.tcp.Accept()
+		if err != nil {
+			return
+		}
+		go serveStream(conn, func(query []byte) []byte {
+			atomic.AddInt32(&s.tcpQueries, 1)
+			return s.answer(query, true)
+		})
+	}
+}
+
+/**
+  Read queries with length and write responses with length until the conn is closed
+  A nil response closes the conn
+**/
+func serveStream(conn net.Conn, answer func(query []byte) []byte) {
+	defer conn.Close()
+	for {
+		length := make([]byte, 2)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return
+		}
+		query := make([]byte, binary.BigEndian.Uint16(length))
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+		response := answer(query)
+		if response == nil {
+			return
+		}
+		message := make([]byte, 2, 2+len(response))
+		binary.BigEndian.PutUint16(message, uint16(len(response)))
+		if _, err := conn.Write(append(message, response...)); err != nil {
+			return
+		}
+	}
+}
+
+/**
+  Response with the same addresses for every name
+**/
+func addresses(ttl uint32, ips ...net.IP) func(query []byte, tcp bool) []byte {
+	return func(query []byte, tcp bool) []byte {
+		_, qtype, err := ParseQuestion(query)
+		if err != nil {
+			return nil
+		}
+		response, _ := NewResponse(query, qtype, ips, ttl)
+		return response
+	}
+}
+
+/**
+  Name error with a soa record in authority, soa ttl and minimum decide the negative ttl
+**/
+func nameError(soaTTL, minimum uint32) []byte {
+	query, _ := testQuery("missing.example")
+	response, _ := NewErrorResponse(query, RcodeNameError)
+	binary.BigEndian.PutUint16(response[8:], 1)
+	response = append(response, 0xC0, headerLength)
+	response = appendUint16(response, TypeSOA)
+	response = appendUint16(response, ClassIN)
+	response = binary.BigEndian.AppendUint32(response, soaTTL)
+	// two root names and five numbers
+	response = appendUint16(response, 22)
+	response = append(response, 0, 0)
+	for _, value := range []uint32{1, 7200, 900, 1209600, minimum} {
+		response = binary.BigEndian.AppendUint32(response, value)
+	}
+	return response
+}
+
+func testQuery(name string) ([]byte, error) {
+	_, query, err := newQuery(name, TypeA)
+	return query, err
+}
+
+func newTestResolver(t *testing.T, config Config) *Resolver {
+	if config.Prefer == "" {
+		config.Prefer = OnlyIPv4
+	}
+	if config.Timeout == 0 {
+		config.Timeout = time.Second
+	}
+	r, err := NewResolver(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+/**
+  A second lookup is answered by cache, an expired answer is asked again
+**/
+func TestLookupCache(t *testing.T) {
+	server := newStandIn(t, addresses(1, net.IPv4(10, 0, 0, 1)))
+	r := newTestResolver(t, Config{Servers: []string{server.address()}, CacheSize: 16})
+	for i := 0; i < 3; i++ {
+		ips, err := r.Lookup("Cached.Example.")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ips) != 1 || !ips[0].Equal(net.IPv4(10, 0, 0, 1)) {
+			t.Fatalf("got %v", ips)
+		}
+	}
+	if queries := atomic.LoadInt32(&server.udpQueries); queries != 1 {
+		t.Fatalf("%d queries, want 1", queries)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if _, err := r.Lookup("cached.example"); err != nil {
+		t.Fatal(err)
+	}
+	if queries := atomic.LoadInt32(&server.udpQueries); queries != 2 {
+		t.Fatalf("%d queries after ttl, want 2", queries)
+	}
+}
+
+/**
+  Max ttl caps a long ttl, and a cache of size 0 asks every time
+**/
+func TestLookupMaxTTLAndNoCache(t *testing.T) {
+	server := newStandIn(t, addresses(86400, net.IPv4(10, 0, 0, 2)))
+	r := newTestResolver(t, Config{Servers: []string{server.address()}, CacheSize: 16, MaxTTL: 100 * time.Millisecond})
+	_, _ = r.Lookup("capped.example")
+	time.Sleep(150 * time.Millisecond)
+	_, _ = r.Lookup("capped.example")
+	if queries := atomic.LoadInt32(&server.udpQueries); queries != 2 {
+		t.Fatalf("%d queries with max ttl, want 2", queries)
+	}
+	r = newTestResolver(t, Config{Servers: []string{server.address()}})
+	_, _ = r.Lookup("capped.example")
+	_, _ = r.Lookup("capped.example")
+	if queries := atomic.LoadInt32(&server.udpQueries); queries != 4 {
+		t.Fatalf("%d queries without cache, want 4", queries)
+	}
+}
+
+/**
+  A missing name is cached for soa minimum when it is below negative ttl
+  and for negative ttl when the response has no soa
+**/
+func TestLookupNegativeTTL(t *testing.T) {
+	withSOA := nameError(300, 1)
+	server := newStandIn(t, func(query []byte, tcp bool) []byte {
+		response := append([]byte(nil), withSOA...)
+		copy(response, query[:2])
+		return response
+	})
+	r := newTestResolver(t, Config{Servers: []string{server.address()}, CacheSize: 16, NegativeTTL: time.Hour})
+	for i := 0; i < 2; i++ {
+		if _, err := r.Lookup("missing.example"); err != ErrNotFound {
+			t.Fatalf("got %v, want %v", err, ErrNotFound)
+		}
+	}
+	if queries := atomic.LoadInt32(&server.udpQueries); queries != 1 {
+		t.Fatalf("%d queries, want 1", queries)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	_, _ = r.Lookup("missing.example")
+	if queries := atomic.LoadInt32(&server.udpQueries); queries != 2 {
+		t.Fatalf("%d queries after soa minimum, want 2", queries)
+	}
+
+	noSOA := newStandIn(t, func(query []byte, tcp bool) []byte {
+		response, _ := NewErrorResponse(query, RcodeNameError)
+		return response
+	})
+	r = newTestResolver(t, Config{Servers: []string{noSOA.address()}, CacheSize: 16, NegativeTTL: 200 * time.Millisecond})
+	_, _ = r.Lookup("missing.example")
+	_, _ = r.Lookup("missing.example")
+	if queries := atomic.LoadInt32(&noSOA.udpQueries); queries != 1 {
+		t.Fatalf("%d queries without soa, want 1", queries)
+	}
+	time.Sleep(250 * time.Millisecond)
+	_, _ = r.Lookup("missing.example")
+	if queries := atomic.LoadInt32(&noSOA.udpQueries); queries != 2 {
+		t.Fatalf("%d queries after negative ttl, want 2", queries)
+	}
+}
+
+/**
+  A truncated udp response is asked again over tcp, which has all addresses
+**/
+func TestLookupTruncatedFallsBackToTCP(t *testing.T) {
+	var ips []net.IP
+	for i := 1; i <= 100; i++ {
+		ips = append(ips, net.IPv4(10, 0, 1, byte(i)))
+	}
+	full := addresses(60, ips...)
+	server := newStandIn(t, func(query []byte, tcp bool) []byte {
+		response := full(query, tcp)
+		if tcp {
+			return response
+		}
+		return FitUDP(query, response)
+	})
+	r := newTestResolver(t, Config{Servers: []string{server.address()}})
+	found, err := r.Lookup("many.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != len(ips) {
+		t.Fatalf("got %d addresses, want %d", len(found), len(ips))
+	}
+	if atomic.LoadInt32(&server.udpQueries) != 1 || atomic.LoadInt32(&server.tcpQueries) != 1 {
+		t.Fatalf("udp %d and tcp %d queries, want 1 and 1", server.udpQueries, server.tcpQueries)
+	}
+}
+
+/**
+  Upstream which returns a fixed response, so checks of Exchange are tested without checks of transports
+**/
+type fixedUpstream struct {
+	response func(query []byte) []byte
+	err      error
+}
+
+func (u *fixedUpstream) exchange(query []byte, deadline time.Time) ([]byte, error) {
+	if u.err != nil {
+		return nil, u.err
+	}
+	return u.response(query), nil
+}
+
+func (u *fixedUpstream) String() string {
+	return "fixed"
+}
+
+/**
+  Exchange skips failed upstreams, server failures and responses of another query
+**/
+func TestExchange(t *testing.T) {
+	query, err := testQuery("exchange.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	good := &fixedUpstream{response: func(query []byte) []byte {
+		response, _ := NewResponse(query, TypeA, []net.IP{net.IPv4(10, 0, 0, 3)}, 60)
+		return response
+	}}
+	serverFailure := &fixedUpstream{response: func(query []byte) []byte {
+		response, _ := NewErrorResponse(query, RcodeServerFailure)
+		return response
+	}}
+	otherID := &fixedUpstream{response: func(query []byte) []byte {
+		response, _ := NewResponse(query, TypeA, []net.IP{net.IPv4(10, 6, 6, 6)}, 60)
+		response[0] ^= 0xFF
+		return response
+	}}
+	broken := &fixedUpstream{err: errors.New("broken")}
+
+	r := &Resolver{upstreams: []upstream{broken, serverFailure, otherID, good}, timeout: time.Second}
+	response, err := r.Exchange(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := parseAnswer(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.ips) != 1 || !result.ips[0].Equal(net.IPv4(10, 0, 0, 3)) {
+		t.Fatalf("got %v from wrong upstream", result.ips)
+	}
+
+	r = &Resolver{upstreams: []upstream{otherID}, timeout: time.Second}
+	if _, err = r.Exchange(query); err != errMismatch {
+		t.Fatalf("got %v, want %v", err, errMismatch)
+	}
+}
+
+/**
+  Responses over udp and tcp with another id are not taken
+**/
+func TestTransportsRejectOtherID(t *testing.T) {
+	server := newStandIn(t, func(query []byte, tcp bool) []byte {
+		response, _ := NewErrorResponse(query, RcodeNameError)
+		response[0] ^= 0xFF
+		return response
+	})
+	query, _ := testQuery("spoofed.example")
+	deadline := time.Now().Add(300 * time.Millisecond)
+	if _, err := (&udpUpstream{address: server.address()}).exchange(query, deadline); err == nil {
+		t.Fatal("udp took a response with another id")
+	}
+	if _, err := (&tcpUpstream{address: server.address()}).exchange(query, time.Now().Add(time.Second)); err != errMismatch {
+		t.Fatalf("tcp: got %v, want %v", err, errMismatch)
+	}
+}
@@ -0,0 +1,332 @@
+/**
+  Author: JiaCheng Yang && Wenkai Zheng
+  This file is used for the admin api of server proxy
+  It lists sessions and connections, kills them and disables users
+  Every request needs the admin token as a bearer token
+**/
+package Server
+
+import (
+	"Authentication"
+	"Core"
+	"Logging"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/**
+   Admin server holds the same session map as waitForNewConnection and every listener
+   So that it can find every running session
+**/
+type adminServer struct {
+	token     string
+	ipMap     *sync.Map
+	listeners []*listener
+	metrics   *metrics
+	bans      *banList
+}
+
+/**
+   Json format of one session
+**/
+type sessionInfo struct {
+	Session       string    `json:"session"`
+	User          string    `json:"user"`
+	IP            string    `json:"ip"`
+	Listener      string    `json:"listener"`
+	Connections   int       `json:"connections"`
+	UploadBytes   int64     `json:"upload_bytes"`
+	DownloadBytes int64     `json:"download_bytes"`
+	CreatedAt     time.Time `json:"created_at"`
+	Liveness      string    `json:"liveness"`
+	RttMs         float64   `json:"rtt_ms"`
+	SmoothedRttMs float64   `json:"smoothed_rtt_ms"`
+}
+
+/**
+   Json format of one connection
+**/
+type connectionInfo struct {
+	Id            uint64    `json:"id"`
+	Target        string    `json:"target"`
+	UploadBytes   int64     `json:"upload_bytes"`
+	DownloadBytes int64     `json:"download_bytes"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+/**
+   Admin api must only be reachable from this host
+**/
+func checkLoopback(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if host == "localhost" {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !ip.IsLoopback() {
+		return errors.New("admin api can only listen on a loopback address")
+	}
+	return nil
+}
+
+/**
+   This function starts admin api in another go routine
+   The returned http server can be used for shutting down
+**/
+func startAdmin(config ServerConfig, ipMap *sync.Map, listeners []*listener, metrics *metrics, bans *banList) (*http.Server, error) {
+	if config.GetAdminToken() == "" {
+		return nil, errors.New("admin token is empty, admin api is disabled")
+	}
+	if err := checkLoopback(config.GetAdminAddr()); err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", config.GetAdminAddr())
+	if err != nil {
+		return nil, err
+	}
+	admin := &adminServer{token: config.GetAdminToken(), ipMap: ipMap, listeners: listeners, metrics: metrics, bans: bans}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sessions", admin.authenticate(http.MethodGet, admin.listSessions))
+	mux.HandleFunc("/sessions/kill", admin.authenticate(http.MethodPost, admin.killSession))
+	mux.HandleFunc("/connections", admin.authenticate(http.MethodGet, admin.listConnections))
+	mux.HandleFunc("/connections/kill", admin.authenticate(http.MethodPost, admin.killConnection))
+	mux.HandleFunc("/users/disable", admin.authenticate(http.MethodPost, admin.disableUser))
+	mux.HandleFunc("/users/enable", admin.authenticate(http.MethodPost, admin.enableUser))
+	mux.HandleFunc("/bans", admin.authenticate(http.MethodGet, admin.listBans))
+	mux.HandleFunc("/bans/lift", admin.authenticate(http.MethodPost, admin.liftBan))
+	mux.HandleFunc("/metrics", admin.authenticate(http.MethodGet, admin.writeMetrics))
+	server := &http.Server{Handler: mux}
+	go func() {
+		Logging.NormalLogger.Println("admin api is listening on", listener.Addr().String())
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			Logging.ErrorLogger.Println(err)
+		}
+	}()
+	return server, nil
+}
+
+/**
+   Check method and bearer token before calling the real handler
+**/
+func (a *adminServer) authenticate(method string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		given := []byte(r.Header.Get("Authorization"))
+		expected := []byte("Bearer " + a.token)
+		if subtle.ConstantTimeCompare(given, expected) != 1 {
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		if r.Method != method {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		handler(w, r)
+	}
+}
+
+/**
+   Write any value as json
+**/
+func writeJson(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		Logging.ErrorLogger.Println(err)
+	}
+}
+
+/**
+   Write an error message as json
+**/
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJson(w, status, map[string]string{"error": message})
+}
+
+/**
+   Round trip time is shown in milliseconds
+**/
+func toMilliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+/**
+   Find a session by the key in ip map
+**/
+func (a *adminServer) findSession(key string) *Session {
+	value, ok := a.ipMap.Load(key)
+	if !ok {
+		return nil
+	}
+	return value.(*Session)
+}
+
+/**
+   Collect all sessions which already signed in
+**/
+func (a *adminServer) getSessions() []*Session {
+	var sessions []*Session
+	a.ipMap.Range(func(key interface{}, value interface{}) bool {
+		sessions = append(sessions, value.(*Session))
+		return true
+	})
+	return sessions
+}
+
+/**
+   GET /sessions
+**/
+func (a *adminServer) listSessions(w http.ResponseWriter, r *http.Request) {
+	infos := []sessionInfo{}
+	for _, session := range a.getSessions() {
+		rtt, smoothedRtt := session.liveness.GetRtt()
+		infos = append(infos, sessionInfo{
+			Session:       session.keyInMap,
+			User:          session.username,
+			IP:            calculateKey(session.controlTcpConn),
+			Listener:      session.listener.name,
+			Connections:   len(session.getConnections()),
+			UploadBytes:   session.getUploadBytes(),
+			DownloadBytes: session.getDownloadBytes(),
+			CreatedAt:     session.createdAt,
+			Liveness:      session.liveness.GetState(),
+			RttMs:         toMilliseconds(rtt),
+			SmoothedRttMs: toMilliseconds(smoothedRtt),
+		})
+	}
+	writeJson(w, http.StatusOK, infos)
+}
+
+/**
+   GET /connections?session=key
+**/
+func (a *adminServer) listConnections(w http.ResponseWriter, r *http.Request) {
+	session := a.findSession(r.URL.Query().Get("session"))
+	if session == nil {
+		writeError(w, http.StatusNotFound, "session not found")
+		return
+	}
+	infos := []connectionInfo{}
+	for _, connection := range session.getConnections() {
+		infos = append(infos, connectionInfo{
+			Id:            connection.GetId(),
+			Target:        connection.GetTarget(),
+			UploadBytes:   connection.GetUploadBytes(),
+			DownloadBytes: connection.GetDownloadBytes(),
+			CreatedAt:     connection.GetCreatedAt(),
+		})
+	}
+	writeJson(w, http.StatusOK, infos)
+}
+
+/**
+   POST /connections/kill?id=n
+**/
+func (a *adminServer) killConnection(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid connection id")
+		return
+	}
+	for _, session := range a.getSessions() {
+		for _, connection := range session.getConnections() {
+			if connection.GetId() == id {
+				connection.Close(Core.CloseKilled)
+				Logging.NormalLogger.Println("admin killed connection", id)
+				writeJson(w, http.StatusOK, map[string]uint64{"killed": id})
+				return
+			}
+		}
+	}
+	writeError(w, http.StatusNotFound, "connection not found")
+}
+
+/**
+   POST /sessions/kill?session=key
+**/
+func (a *adminServer) killSession(w http.ResponseWriter, r *http.Request) {
+	session := a.findSession(r.URL.Query().Get("session"))
+	if session == nil {
+		writeError(w, http.StatusNotFound, "session not found")
+		return
+	}
+	session.closeSession()
+	Logging.NormalLogger.Println("admin killed session", session.keyInMap)
+	writeJson(w, http.StatusOK, map[string]string{"killed": session.keyInMap})
+}
+
+/**
+   User can be given as the plain user name or the encoded one from /sessions
+**/
+func getEncodedUser(r *http.Request) string {
+	return Authentication.NormalizeUsername(r.URL.Query().Get("user"))
+}
+
+/**
+   POST /users/disable?user=name
+   Running sessions of this user on every listener are closed as well
+**/
+func (a *adminServer) disableUser(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("user") == "" {
+		writeError(w, http.StatusBadRequest, "user is required")
+		return
+	}
+	user := getEncodedUser(r)
+	Authentication.DisableUser(user)
+	for _, l := range a.listeners {
+		if value, ok := l.userMap.Load(user); ok {
+			value.(*Session).closeSession()
+		}
+	}
+	Logging.NormalLogger.Println("admin disabled user", user)
+	writeJson(w, http.StatusOK, map[string]string{"disabled": user})
+}
+
+/**
+   POST /users/enable?user=name
+**/
+func (a *adminServer) enableUser(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("user") == "" {
+		writeError(w, http.StatusBadRequest, "user is required")
+		return
+	}
+	user := getEncodedUser(r)
+	Authentication.EnableUser(user)
+	Logging.NormalLogger.Println("admin enabled user", user)
+	writeJson(w, http.StatusOK, map[string]string{"enabled": user})
+}
+
+/**
+   GET /bans
+**/
+func (a *adminServer) listBans(w http.ResponseWriter, r *http.Request) {
+	writeJson(w, http.StatusOK, a.bans.getBans())
+}
+
+/**
+   POST /bans/lift?ip=IP or POST /bans/lift?user=name
+**/
+func (a *adminServer) liftBan(w http.ResponseWriter, r *http.Request) {
+	kind, value := BanIP, r.URL.Query().Get("ip")
+	if value == "" {
+		if r.URL.Query().Get("user") == "" {
+			writeError(w, http.StatusBadRequest, "ip or user is required")
+			return
+		}
+		kind, value = BanUser, getEncodedUser(r)
+	}
+	if !a.bans.lift(kind, value) {
+		writeError(w, http.StatusNotFound, "ban not found")
+		return
+	}
+	Logging.NormalLogger.Println("admin lifted ban of", kind, value)
+	writeJson(w, http.StatusOK, map[string]string{"lifted": value})
+}
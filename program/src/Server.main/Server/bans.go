@@ -0,0 +1,315 @@
+/**
+  Author: JiaCheng Yang && Wenkai Zheng
+  This file is used for brute force protection of sign in
+  Failed sign ins are counted for source IP and for user name
+  After too many failures the IP or user is banned, every next ban is twice as long
+  Bans are saved in a json file so that they are kept after restart
+  A banned user is only refused from IPs which failed, so others can not lock a user out by failing on purpose
+**/
+package Server
+
+import (
+	"FileParser"
+	"Logging"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+/**
+   Kinds of ban
+**/
+const (
+	BanIP   = "ip"
+	BanUser = "user"
+)
+
+/**
+   Failures and bans which are expired are removed at most once in this time
+   Ban file is written at most once in save delay, so many bans at once do not write it many times
+**/
+const banSweepInterval = time.Minute
+const banSaveDelay = time.Second
+
+/**
+   Json format of one ban, it is also the format of ban file
+**/
+type ban struct {
+	Kind     string    `json:"kind"`
+	Value    string    `json:"value"`
+	Until    time.Time `json:"until"`
+	Failures int       `json:"failures"`
+}
+
+/**
+   Failures of one IP or user
+   Expires is the time when failures are forgotten
+**/
+type failure struct {
+	count   int
+	expires time.Time
+}
+
+/**
+   Ban list is shared by all sign ins
+   Threshold is the number of failures before first ban, 0 means no ban
+   Save timer is running when bans are changed and not written yet, save mutex keeps writes in order
+**/
+type banList struct {
+	mutex     sync.Mutex
+	saveMutex sync.Mutex
+	path      string
+	threshold int
+	baseTime  time.Duration
+	maxTime   time.Duration
+	window    time.Duration
+	failures  map[string]*failure
+	bans      map[string]*ban
+	lastSweep time.Time
+	saveTimer *time.Timer
+}
+
+/**
+   Simple constructor for ban list, bans which are not expired are loaded from path
+**/
+func newBanList(config ServerConfig) *banList {
+	b := &banList{
+		path:      config.BanPath,
+		threshold: config.BanThreshold,
+		baseTime:  time.Duration(config.BanTime) * time.Second,
+		maxTime:   time.Duration(config.BanMaxTime) * time.Second,
+		window:    time.Duration(config.FailureWindow) * time.Second,
+		failures:  make(map[string]*failure),
+		bans:      make(map[string]*ban),
+		lastSweep: time.Now(),
+	}
+	if b.path == "" {
+		return b
+	}
+	var saved []ban
+	if _, err := os.Stat(b.path); err != nil {
+		return b
+	}
+	if err := FileParser.GetJasonConfig(b.path, &saved); err != nil {
+		Logging.ErrorLogger.Println("cannot load bans", err)
+		return b
+	}
+	now := time.Now()
+	for i := range saved {
+		if saved[i].Until.After(now) {
+			b.bans[banKey(saved[i].Kind, saved[i].Value)] = &saved[i]
+			// next failure after restart still gets a longer ban
+			b.failures[banKey(saved[i].Kind, saved[i].Value)] = &failure{
+				count:   saved[i].Failures,
+				expires: saved[i].Until.Add(b.window),
+			}
+		}
+	}
+	Logging.NormalLogger.Println("loaded", len(b.bans), "bans")
+	return b
+}
+
+func banKey(kind, value string) string {
+	return kind + ":" + value
+}
+
+/**
+   Check an IP or user is banned now, expired bans are removed
+**/
+func (b *banList) isBanned(kind, value string) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	key := banKey(kind, value)
+	item, ok := b.bans[key]
+	if !ok {
+		return false
+	}
+	if time.Now().Before(item.Until) {
+		return true
+	}
+	delete(b.bans, key)
+	b.scheduleSave()
+	return false
+}
+
+/**
+   A banned user is refused only when the IP has failed as well
+   So a correct sign in from an IP which never failed is not locked out by failures of others
+**/
+func (b *banList) isUserBanned(user, ip string) bool {
+	if !b.isBanned(BanUser, user) {
+		return false
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	item, ok := b.failures[banKey(BanIP, ip)]
+	return ok && time.Now().Before(item.expires)
+}
+
+/**
+   Remove failures and bans which are expired, it is called with mutex locked
+**/
+func (b *banList) sweep(now time.Time) {
+	if now.Sub(b.lastSweep) < banSweepInterval {
+		return
+	}
+	b.lastSweep = now
+	for key, item := range b.failures {
+		if now.After(item.expires) {
+			delete(b.failures, key)
+		}
+	}
+	changed := false
+	for key, item := range b.bans {
+		if !now.Before(item.Until) {
+			delete(b.bans, key)
+			changed = true
+		}
+	}
+	if changed {
+		b.scheduleSave()
+	}
+}
+
+/**
+   Count a failed sign in of an IP or user
+   When failures reach threshold it is banned for base time
+   and every next failure doubles the time up to max time
+**/
+func (b *banList) fail(kind, value string) {
+	if b.threshold <= 0 {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	key := banKey(kind, value)
+	now := time.Now()
+	b.sweep(now)
+	item, ok := b.failures[key]
+	if !ok || now.After(item.expires) {
+		item = &failure{}
+		b.failures[key] = item
+	}
+	item.count++
+	item.expires = now.Add(b.window)
+	Logging.NormalLogger.Println("failed sign in of", kind, value, item.count, "times")
+	if item.count < b.threshold {
+		return
+	}
+	duration := b.baseTime
+	for i := b.threshold; i < item.count && duration < b.maxTime; i++ {
+		duration *= 2
+	}
+	if duration > b.maxTime {
+		duration = b.maxTime
+	}
+	until := now.Add(duration)
+	item.expires = until.Add(b.window)
+	b.bans[key] = &ban{Kind: kind, Value: value, Until: until, Failures: item.count}
+	Logging.NormalLogger.Println("banned", kind, value, "for", duration)
+	b.scheduleSave()
+}
+
+/**
+   A successful sign in forgets failures of the IP and user
+**/
+func (b *banList) succeed(ip, user string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	delete(b.failures, banKey(BanIP, ip))
+	delete(b.failures, banKey(BanUser, user))
+}
+
+/**
+   Lift a ban, failures are forgotten as well
+   It returns false when there is no such ban
+**/
+func (b *banList) lift(kind, value string) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	key := banKey(kind, value)
+	delete(b.failures, key)
+	if _, ok := b.bans[key]; !ok {
+		return false
+	}
+	delete(b.bans, key)
+	b.scheduleSave()
+	return true
+}
+
+/**
+   All bans which are not expired, the earliest to expire comes first
+**/
+func (b *banList) getBans() []ban {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	now := time.Now()
+	bans := []ban{}
+	for _, item := range b.bans {
+		if item.Until.After(now) {
+			bans = append(bans, *item)
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].Until.Before(bans[j].Until)
+	})
+	return bans
+}
+
+/**
+   Write bans after save delay, changes in that time are written together
+   It is called with mutex locked
+**/
+func (b *banList) scheduleSave() {
+	if b.path == "" || b.saveTimer != nil {
+		return
+	}
+	b.saveTimer = time.AfterFunc(banSaveDelay, b.save)
+}
+
+/**
+   Write bans at once when a save is waiting, it is called when server proxy stops
+**/
+func (b *banList) flush() {
+	b.mutex.Lock()
+	waiting := b.saveTimer != nil
+	b.mutex.Unlock()
+	if waiting {
+		b.save()
+	}
+}
+
+/**
+   Write bans into a temporary file and rename it, so the file is never half written
+   Bans are copied with mutex locked, the file is written without it so sign ins are not blocked
+**/
+func (b *banList) save() {
+	if b.path == "" {
+		return
+	}
+	b.saveMutex.Lock()
+	defer b.saveMutex.Unlock()
+	b.mutex.Lock()
+	if b.saveTimer != nil {
+		b.saveTimer.Stop()
+		b.saveTimer = nil
+	}
+	bans := []ban{}
+	for _, item := range b.bans {
+		bans = append(bans, *item)
+	}
+	b.mutex.Unlock()
+	content, err := json.MarshalIndent(bans, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(b.path+".tmp", content, 0600)
+	}
+	if err == nil {
+		err = os.Rename(b.path+".tmp", b.path)
+	}
+	if err != nil {
+		Logging.ErrorLogger.Println("cannot save bans", err)
+	}
+}
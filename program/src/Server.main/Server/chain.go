@@ -0,0 +1,72 @@
+/**
+  Author: JiaCheng Yang && Wenkai Zheng
+  This file is used for choosing a chain of upstream proxies for a request
+  Requests which match no rule use upstream chain, an empty chain connects targets directly
+**/
+package Server
+
+import (
+	"Core"
+)
+
+/**
+  One upstream rule in server config, users and targets are the same as egress rules
+  An empty chain connects matching requests directly, so some targets can skip the default chain
+**/
+type UpstreamRule struct {
+	Users   []string `json:"users"`
+	Targets []string `json:"targets"`
+	Chain   []string `json:"chain"`
+}
+
+type upstreamRule struct {
+	matcher *ruleMatcher
+	chain   *Core.Chain
+}
+
+/**
+  Chain is used when no rule matches, nil chain means direct
+**/
+type upstreams struct {
+	rules []*upstreamRule
+	chain *Core.Chain
+}
+
+/**
+  Simple constructor for upstreams, it fails on a wrong proxy
+**/
+func newUpstreams(config ServerConfig) (*upstreams, error) {
+	u := &upstreams{}
+	chain, err := newOptionalChain(config.UpstreamChain)
+	if err != nil {
+		return nil, err
+	}
+	u.chain = chain
+	for _, rule := range config.UpstreamRules {
+		item := &upstreamRule{matcher: newRuleMatcher(rule.Users, rule.Targets)}
+		if item.chain, err = newOptionalChain(rule.Chain); err != nil {
+			return nil, err
+		}
+		u.rules = append(u.rules, item)
+	}
+	return u, nil
+}
+
+func newOptionalChain(proxies []string) (*Core.Chain, error) {
+	if len(proxies) == 0 {
+		return nil, nil
+	}
+	return Core.NewChain(proxies)
+}
+
+/**
+  Find the chain of a request of user, nil means direct
+**/
+func (u *upstreams) choose(user string, target *Core.SocksAddr) *Core.Chain {
+	for _, rule := range u.rules {
+		if rule.matcher.matches(user, target) {
+			return rule.chain
+		}
+	}
+	return u.chain
+}
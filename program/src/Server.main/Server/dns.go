@@ -0,0 +1,70 @@
+/**
+  Author: JiaCheng Yang && Wenkai Zheng
+  This file is used for control frames from local proxy, most of them are dns queries
+  Dns queries are sent on control tcp conn
+  They are answered by resolver of server proxy, so they do not leak on the network of local proxy
+**/
+package Server
+
+import (
+	"Core"
+	"Logging"
+	"Resolver"
+	"errors"
+)
+
+/**
+  Max dns queries of one session at the same time, more are dropped and local proxy times out
+**/
+const maxDNSQueries = 64
+
+/**
+  Frames which are not ping or pong come here
+  Resolving takes time, so it runs in another go routine and heartbeat is not blocked
+**/
+func (s *Session) handleControl(frameType byte, payload []byte) error {
+	switch frameType {
+	case Core.ControlDNSQuery:
+		return s.queryDNS(payload)
+	case Core.ControlReverseOpen:
+		return s.openReverse(payload)
+	}
+	return errors.New("unknown control frame")
+}
+
+/**
+  Dns query frame, it is dropped when too many are running
+**/
+func (s *Session) queryDNS(payload []byte) error {
+	select {
+	case s.dnsQueries <- struct{}{}:
+	default:
+		Logging.NormalLogger.Println("too many dns queries from", s.keyInMap)
+		return nil
+	}
+	go func() {
+		defer func() { <-s.dnsQueries }()
+		s.answerDNS(payload)
+	}()
+	return nil
+}
+
+/**
+  Resolve a query and send the response, a query which fails gets server failure
+**/
+func (s *Session) answerDNS(query []byte) {
+	var response []byte
+	err := errors.New("server proxy has no resolver")
+	if resolver := s.proxy.GetResolver(); resolver != nil {
+		response, err = resolver.Exchange(query)
+	}
+	if err != nil {
+		Logging.ErrorLogger.Println("could not answer dns query", err)
+		if response, err = Resolver.NewErrorResponse(query, Resolver.RcodeServerFailure); err != nil {
+			return
+		}
+	}
+	if err = s.control.WriteFrame(Core.ControlDNSAnswer, response); err != nil {
+		Logging.ErrorLogger.Println(err)
+	}
+}
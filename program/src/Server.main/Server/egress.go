@@ -0,0 +1,188 @@
+/**
+  Author: JiaCheng Yang && Wenkai Zheng
+  This file is used for the local side of conns from server proxy to targets
+  A server with many public addresses can pin users or targets to some of them
+  Addresses of a pool are used in turns, an interface is bound by SO_BINDTODEVICE on linux (it needs CAP_NET_RAW)
+**/
+package Server
+
+import (
+	"Authentication"
+	"Core"
+	"errors"
+	"net"
+	"strings"
+	"sync/atomic"
+)
+
+/**
+  One egress rule in server config, rules are checked in order and the first one which matches is used
+  Users are plain user names, users and targets are empty to match everyone, a target is a domain (with its subdomains), an ip or a cidr
+  A domain matches only a request with that name and a cidr only a request with an ip
+**/
+type EgressRule struct {
+	Users     []string `json:"users"`
+	Targets   []string `json:"targets"`
+	Addresses []string `json:"addresses"`
+	Interface string   `json:"interface"`
+}
+
+/**
+  Local addresses of each family and an interface
+  Next is shared by both families, so turns are kept across requests
+**/
+type egressPool struct {
+	ipv4   []net.IP
+	ipv6   []net.IP
+	device string
+	next   uint32
+}
+
+/**
+  Users and targets of a rule, upstream rules use it as well
+**/
+type ruleMatcher struct {
+	users    map[string]bool
+	domains  []string
+	networks []*net.IPNet
+}
+
+type egressRule struct {
+	matcher *ruleMatcher
+	pool    *egressPool
+}
+
+/**
+  Pool is used when no rule matches, nil pool lets the system choose
+**/
+type egress struct {
+	rules []*egressRule
+	pool  *egressPool
+}
+
+/**
+  Simple constructor for egress, it fails on a wrong address or target
+**/
+func newEgress(config ServerConfig) (*egress, error) {
+	e := &egress{}
+	pool, err := newEgressPool(config.EgressAddresses, config.EgressInterface)
+	if err != nil {
+		return nil, err
+	}
+	e.pool = pool
+	for _, rule := range config.EgressRules {
+		item := &egressRule{matcher: newRuleMatcher(rule.Users, rule.Targets)}
+		if item.pool, err = newEgressPool(rule.Addresses, rule.Interface); err != nil {
+			return nil, err
+		}
+		e.rules = append(e.rules, item)
+	}
+	return e, nil
+}
+
+/**
+  Simple constructor for rule matcher
+**/
+func newRuleMatcher(users, targets []string) *ruleMatcher {
+	matcher := &ruleMatcher{users: make(map[string]bool)}
+	// sessions know users by encoded names, an encoded name can be given as well
+	for _, user := range users {
+		matcher.users[Authentication.NormalizeUsername(user)] = true
+	}
+	for _, target := range targets {
+		if _, network, err := net.ParseCIDR(target); err == nil {
+			matcher.networks = append(matcher.networks, network)
+		} else if ip := net.ParseIP(target); ip != nil {
+			matcher.networks = append(matcher.networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+		} else if target = strings.ToLower(strings.Trim(target, ".")); target != "" {
+			matcher.domains = append(matcher.domains, target)
+		}
+	}
+	return matcher
+}
+
+/**
+  Nil pool means there is nothing to bind
+**/
+func newEgressPool(addresses []string, device string) (*egressPool, error) {
+	if len(addresses) == 0 && device == "" {
+		return nil, nil
+	}
+	pool := &egressPool{device: device}
+	for _, address := range addresses {
+		ip := net.ParseIP(strings.Trim(address, "[]"))
+		if ip == nil {
+			return nil, errors.New("wrong egress address " + address)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			pool.ipv4 = append(pool.ipv4, ip4)
+		} else {
+			pool.ipv6 = append(pool.ipv6, ip)
+		}
+	}
+	return pool, nil
+}
+
+/**
+  Find the pool of a request of user
+**/
+func (e *egress) choose(user string, target *Core.SocksAddr) *egressPool {
+	for _, rule := range e.rules {
+		if rule.matcher.matches(user, target) {
+			return rule.pool
+		}
+	}
+	return e.pool
+}
+
+/**
+  A rule matches when both users and targets match
+**/
+func (r *ruleMatcher) matches(user string, target *Core.SocksAddr) bool {
+	if len(r.users) > 0 && !r.users[user] {
+		return false
+	}
+	if len(r.domains) == 0 && len(r.networks) == 0 {
+		return true
+	}
+	if target.Type == Core.DomainName {
+		name := strings.ToLower(strings.TrimSuffix(target.Name, "."))
+		for _, domain := range r.domains {
+			if name == domain || strings.HasSuffix(name, "."+domain) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, network := range r.networks {
+		if network.Contains(target.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+  Dialer for each attempt, the local address has the family of the target
+  A family without addresses in the pool is left to the system
+**/
+func (p *egressPool) dialerFor() Core.DialerFor {
+	if p == nil {
+		return nil
+	}
+	return func(addr *net.TCPAddr) net.Dialer {
+		var dialer net.Dialer
+		ips := p.ipv6
+		if addr.IP.To4() != nil {
+			ips = p.ipv4
+		}
+		if len(ips) > 0 {
+			index := (atomic.AddUint32(&p.next, 1) - 1) % uint32(len(ips))
+			dialer.LocalAddr = &net.TCPAddr{IP: ips[index]}
+		}
+		if p.device != "" {
+			dialer.Control = bindToDevice(p.device)
+		}
+		return dialer
+	}
+}
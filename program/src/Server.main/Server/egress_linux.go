@@ -0,0 +1,25 @@
+/**
+  Author: JiaCheng Yang && Wenkai Zheng
+  This file is used for binding egress conns to an interface on linux
+**/
+package Server
+
+import (
+	"syscall"
+)
+
+/**
+  Control of dialer which binds the socket by SO_BINDTODEVICE, it needs CAP_NET_RAW
+**/
+func bindToDevice(device string) func(network, address string, conn syscall.RawConn) error {
+	return func(network, address string, conn syscall.RawConn) error {
+		var bindErr error
+		err := conn.Control(func(fd uintptr) {
+			bindErr = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, device)
+		})
+		if err != nil {
+			return err
+		}
+		return bindErr
+	}
+}
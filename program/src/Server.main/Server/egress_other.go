@@ -0,0 +1,24 @@
+//go:build !linux
+
+/**
+  Author: JiaCheng Yang && Wenkai Zheng
+  This file is used for egress interfaces on systems other than linux
+  Only linux has SO_BINDTODEVICE, so a conn of a pool with an interface fails
+**/
+package Server
+
+import (
+	"errors"
+	"syscall"
+)
+
+var errBindToDevice = errors.New("egress interface is only supported on linux")
+
+/**
+  Control of dialer which refuses every conn
+**/
+func bindToDevice(device string) func(network, address string, conn syscall.RawConn) error {
+	return func(network, address string, conn syscall.RawConn) error {
+		return errBindToDevice
+	}
+}
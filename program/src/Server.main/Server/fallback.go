@@ -0,0 +1,106 @@
+/**
+  Author: JiaCheng Yang && Wenkai Zheng
+  This file is used for clients which are not local proxy
+  Server proxy never tells them why they are refused
+  Bytes which are already read are forwarded to fallback address (for example a local web server)
+  Without fallback address they are read and dropped until handshake timeout
+  So a prober can not tell server proxy from another service
+**/
+package Server
+
+import (
+	"Core"
+	"Logging"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+/**
+   The tcp conn is given to fallback, caller must not close it
+**/
+var errRejected = errors.New("client is rejected")
+
+/**
+   Client closed or handshake timeout, there is nothing to give to fallback
+**/
+func isGone(err error) bool {
+	if err == io.EOF {
+		return true
+	}
+	_, ok := err.(net.Error)
+	return ok
+}
+
+/**
+   Fallback address is empty when there is no fallback
+**/
+type fallback struct {
+	addr     string
+	timeouts Core.Timeouts
+}
+
+/**
+   Simple constructor for fallback
+**/
+func newFallback(config ServerConfig) *fallback {
+	return &fallback{addr: config.FallbackAddr, timeouts: config.GetTimeouts()}
+}
+
+/**
+   This function takes the tcp conn in another go routine
+   Received is the bytes which are already read from it
+   It returns errRejected so that caller knows the tcp conn is taken
+**/
+func (f *fallback) reject(localTcpConn net.Conn, received []byte) error {
+	if f.addr == "" {
+		go f.drain(localTcpConn)
+	} else {
+		go f.forward(localTcpConn, received)
+	}
+	return errRejected
+}
+
+/**
+   Read and drop everything until handshake timeout or the client closes
+**/
+func (f *fallback) drain(localTcpConn net.Conn) {
+	timeout := f.timeouts.Handshake
+	if timeout == 0 {
+		timeout = Core.DefaultHandshakeTimeout * time.Second
+	}
+	if err := localTcpConn.SetReadDeadline(time.Now().Add(timeout)); err == nil {
+		_, _ = io.Copy(ioutil.Discard, localTcpConn)
+	}
+	_ = localTcpConn.Close()
+}
+
+/**
+   Connect to fallback address and send received bytes to it
+   Then data is copied without encryption
+**/
+func (f *fallback) forward(localTcpConn net.Conn, received []byte) {
+	fallbackTcpConn, err := Core.DialTCP(f.addr, f.timeouts.Connect)
+	if err != nil {
+		Logging.ErrorLogger.Println("cannot connect to fallback", err)
+		f.drain(localTcpConn)
+		return
+	}
+	if len(received) > 0 {
+		_, err = Core.WriteAll(received, fallbackTcpConn, len(received))
+	}
+	if err == nil {
+		err = Core.SetHandshakeDeadline(localTcpConn, 0)
+	}
+	if err != nil {
+		Logging.ErrorLogger.Println(err)
+		_ = fallbackTcpConn.Close()
+		_ = localTcpConn.Close()
+		return
+	}
+	connection := Core.NewConnectionHandler(localTcpConn, fallbackTcpConn, Core.Server, nil)
+	connection.SetTimeouts(f.timeouts.Idle, f.timeouts.Lifetime)
+	connection.TransferData()
+}
@@ -0,0 +1,162 @@
+/**
+  Author: JiaCheng Yang && Wenkai Zheng
+  This file is used for limits which protect server proxy
+  Total connections, connections of one session, sign in handshakes
+  and new tcp conns per second from one IP are limited
+  Every rejection is counted in metrics
+**/
+package Server
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/**
+   Buckets which are not used for this time are removed
+**/
+const bucketIdleTime = time.Minute
+
+/**
+   Token bucket of one IP, tokens are refilled by rate per second up to burst
+**/
+type bucket struct {
+	tokens   float64
+	lastTime time.Time
+}
+
+/**
+   Limiter is shared by all sessions, 0 means no limit
+   Connections and handshakes are the running ones
+**/
+type limiter struct {
+	maxConnections        int64
+	maxSessionConnections int64
+	maxHandshakes         int64
+	acceptRate            float64
+	acceptBurst           float64
+	connections           int64
+	handshakes            int64
+	bucketMutex           sync.Mutex
+	buckets               map[string]*bucket
+	lastSweep             time.Time
+	metrics               *metrics
+}
+
+/**
+   Simple constructor for limiter
+**/
+func newLimiter(config ServerConfig, metrics *metrics) *limiter {
+	burst := float64(config.AcceptBurst)
+	if burst < float64(config.AcceptRate) {
+		burst = float64(config.AcceptRate)
+	}
+	return &limiter{
+		maxConnections:        int64(config.MaxConnections),
+		maxSessionConnections: int64(config.MaxSessionConnections),
+		maxHandshakes:         int64(config.MaxHandshakes),
+		acceptRate:            float64(config.AcceptRate),
+		acceptBurst:           burst,
+		buckets:               make(map[string]*bucket),
+		lastSweep:             time.Now(),
+		metrics:               metrics,
+	}
+}
+
+/**
+   Take one token from the bucket of this IP
+**/
+func (l *limiter) allowAccept(ip string) bool {
+	if l.acceptRate <= 0 {
+		return true
+	}
+	l.bucketMutex.Lock()
+	defer l.bucketMutex.Unlock()
+	now := time.Now()
+	if now.Sub(l.lastSweep) > bucketIdleTime {
+		for key, b := range l.buckets {
+			if now.Sub(b.lastTime) > bucketIdleTime {
+				delete(l.buckets, key)
+			}
+		}
+		l.lastSweep = now
+	}
+	b, ok := l.buckets[ip]
+	if !ok {
+		b = &bucket{tokens: l.acceptBurst, lastTime: now}
+		l.buckets[ip] = b
+	}
+	b.tokens += now.Sub(b.lastTime).Seconds() * l.acceptRate
+	if b.tokens > l.acceptBurst {
+		b.tokens = l.acceptBurst
+	}
+	b.lastTime = now
+	if b.tokens < 1 {
+		l.metrics.reject(rejectAcceptRate)
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+/**
+   Increase counter unless it would go over max, 0 means no limit
+**/
+func acquire(counter *int64, max int64) bool {
+	if atomic.AddInt64(counter, 1) > max && max > 0 {
+		atomic.AddInt64(counter, -1)
+		return false
+	}
+	return true
+}
+
+/**
+   A sign in handshake must be released when it is finished
+**/
+func (l *limiter) acquireHandshake() bool {
+	if !acquire(&l.handshakes, l.maxHandshakes) {
+		l.metrics.reject(rejectHandshakes)
+		return false
+	}
+	return true
+}
+
+func (l *limiter) releaseHandshake() {
+	atomic.AddInt64(&l.handshakes, -1)
+}
+
+/**
+   A connection counts for the whole server and for its session
+**/
+func (l *limiter) acquireConnection(s *Session) bool {
+	if !acquire(&l.connections, l.maxConnections) {
+		l.metrics.reject(rejectConnections)
+		return false
+	}
+	if !acquire(&s.activeConnections, l.maxSessionConnections) {
+		atomic.AddInt64(&l.connections, -1)
+		l.metrics.reject(rejectSessionConnections)
+		return false
+	}
+	return true
+}
+
+func (l *limiter) releaseConnection(s *Session) {
+	atomic.AddInt64(&s.activeConnections, -1)
+	atomic.AddInt64(&l.connections, -1)
+}
+
+/**
+   Simple getter for running connections
+**/
+func (l *limiter) getConnections() int64 {
+	return atomic.LoadInt64(&l.connections)
+}
+
+/**
+   Simple getter for running sign in handshakes
+**/
+func (l *limiter) getHandshakes() int64 {
+	return atomic.LoadInt64(&l.handshakes)
+}
@@ -0,0 +1,197 @@
+/**
+  Author: JiaCheng Yang && Wenkai Zheng
+  This file is used for listeners of server proxy
+  One process can listen on many ports, for example one port per user or per transport
+  Each listener has its own users, transport and limits
+  A user signs in once per listener, so one user can have a session on each listener
+  Sessions, bans, accounting and admin api are shared by all listeners
+**/
+package Server
+
+import (
+	"Authentication"
+	"Core"
+	"errors"
+	"net"
+	"sync"
+)
+
+/**
+  Name of the listener which is made from top level fields when there is no listener in config
+**/
+const DefaultListener = "default"
+
+var errUserNotAllowed = errors.New("user is not allowed on this listener")
+
+/**
+  One listener in server config, name must be unique
+  Empty strings and 0 are the same as top level fields, negative limits mean no limit
+  Users are plain user names, empty users allow everyone
+**/
+type ListenerConfig struct {
+	Name                  string   `json:"name"`
+	ServerAddr            string   `json:"server_addr"`
+	ServerPort            int      `json:"server_port"`
+	Users                 []string `json:"users"`
+	Transport             string   `json:"transport"`
+	TransportPath         string   `json:"transport_path"`
+	TransportHost         string   `json:"transport_host"`
+	TLSCert               string   `json:"tls_cert"`
+	TLSKey                string   `json:"tls_key"`
+	MaxConnections        int      `json:"max_connections"`
+	MaxSessionConnections int      `json:"max_session_connections"`
+	MaxHandshakes         int      `json:"max_handshakes"`
+	AcceptRate            int      `json:"accept_rate"`
+	AcceptBurst           int      `json:"accept_burst"`
+}
+
+/**
+  Config is the server config with fields of this listener
+  Users is nil when everyone is allowed, user map keeps signed in users of this listener by encoded name
+**/
+type listener struct {
+	name        string
+	config      ServerConfig
+	users       map[string]bool
+	limits      *limiter
+	transport   Core.Transport
+	tcpListener *net.TCPListener
+	userMap     sync.Map
+}
+
+/**
+  Make listeners of config, they share metrics
+  It fails on a wrong listener, listeners which are opened already are closed
+**/
+func newListeners(config ServerConfig, metrics *metrics) ([]*listener, error) {
+	configs := config.Listeners
+	if len(configs) == 0 {
+		configs = []ListenerConfig{{Name: DefaultListener}}
+	}
+	var listeners []*listener
+	names := make(map[string]bool)
+	for _, item := range configs {
+		if item.Name == "" || names[item.Name] {
+			closeListeners(listeners)
+			return nil, errors.New("listener name is empty or used twice: " + item.Name)
+		}
+		names[item.Name] = true
+		l, err := newListener(item, config, metrics)
+		if err != nil {
+			closeListeners(listeners)
+			return nil, errors.New("listener " + item.Name + ": " + err.Error())
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+/**
+  Simple constructor for listener, it starts listening
+**/
+func newListener(item ListenerConfig, config ServerConfig, metrics *metrics) (*listener, error) {
+	config = item.apply(config)
+	l := &listener{name: item.Name, config: config, limits: newLimiter(config, metrics)}
+	if len(item.Users) > 0 {
+		l.users = make(map[string]bool)
+		// sessions know users by encoded names, an encoded name can be given as well
+		for _, user := range item.Users {
+			l.users[Authentication.NormalizeUsername(user)] = true
+		}
+	}
+	transport, err := Core.NewTransport(config.GetTransportConfig())
+	if err != nil {
+		return nil, err
+	}
+	l.transport = transport
+	tcpAddr, err := net.ResolveTCPAddr("tcp", config.GetServerAddr())
+	if err != nil {
+		return nil, err
+	}
+	if l.tcpListener, err = net.ListenTCP("tcp", tcpAddr); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+/**
+  Server config with fields of this listener on top
+**/
+func (item ListenerConfig) apply(config ServerConfig) ServerConfig {
+	// a listener which has its own port does not share the top level address
+	if item.ServerPort != 0 {
+		config.ServerAddr = item.ServerAddr
+		config.ServerPort = item.ServerPort
+	} else if item.ServerAddr != "" {
+		config.ServerAddr = item.ServerAddr
+	}
+	overrideString(&config.Transport, item.Transport)
+	overrideString(&config.TransportPath, item.TransportPath)
+	overrideString(&config.TransportHost, item.TransportHost)
+	overrideString(&config.TLSCert, item.TLSCert)
+	overrideString(&config.TLSKey, item.TLSKey)
+	overrideLimit(&config.MaxConnections, item.MaxConnections)
+	overrideLimit(&config.MaxSessionConnections, item.MaxSessionConnections)
+	overrideLimit(&config.MaxHandshakes, item.MaxHandshakes)
+	overrideLimit(&config.AcceptRate, item.AcceptRate)
+	overrideLimit(&config.AcceptBurst, item.AcceptBurst)
+	config.Listeners = nil
+	return config
+}
+
+func overrideString(field *string, value string) {
+	if value != "" {
+		*field = value
+	}
+}
+
+/**
+  Limiter takes 0 as no limit
+**/
+func overrideLimit(field *int, value int) {
+	if value > 0 {
+		*field = value
+	} else if value < 0 {
+		*field = 0
+	}
+}
+
+/**
+  Check user can sign in on this listener
+**/
+func (l *listener) isAllowed(user string) bool {
+	return l == nil || l.users == nil || l.users[user]
+}
+
+/**
+  Sessions of different listeners are kept apart, so a request is always handled by a session of its own listener
+  The default listener keeps the plain ip
+**/
+func (l *listener) getKey(ip string) string {
+	if l == nil || l.name == DefaultListener {
+		return ip
+	}
+	return l.name + "/" + ip
+}
+
+/**
+  Simple getter for address which listener listens on
+**/
+func (l *listener) getAddr() string {
+	return l.tcpListener.Addr().String()
+}
+
+/**
+  Close every listener, an error is returned for the first one which can not be closed
+  Listener which is closed already by a signal is not an error
+**/
+func closeListeners(listeners []*listener) error {
+	var firstErr error
+	for _, l := range listeners {
+		err := l.tcpListener.Close()
+		if err != nil && firstErr == nil && !errors.Is(err, net.ErrClosed) {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
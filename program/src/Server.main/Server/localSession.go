@@ -11,6 +11,7 @@ import (
 	"Encryption"
 	"Logging"
 	"errors"
+	"fmt"
 	"net"
 	"sync"
 	"sync/atomic"
@@ -18,96 +19,165 @@ import (
 )
 
 /**
-   Session struct will contain username password from user
+   Session struct will contain username from user
    IsRunning means the life cycle
    KeyInmap means IP address from users
    Proxy is either local and server proxy
    Connections is established tcp between two proxy
    Encrption table is for encode and decode
    ipMap is for putting itself into this ipMap(in server.go)
+   ControlTcpConn is the first tcp conn which is used for heartbeat
+   Closed bytes are the bytes from connections which are already finished
+   Accounting is the file which gets one record when session is closed
+   Control and liveness are used for heartbeat on control tcp conn
+   Egress chooses local addresses of conns to targets and upstreams chooses proxies between
+   Reverse is ports of reverse tunnels, reverse listeners listen on them and reverse pending keeps accepted conns by id
+   Dns queries limits dns queries from control tcp conn which are resolved at the same time
 **/
 
 type Session struct {
-	username        string
-	password        string
-	isRunning       int32
-	keyInMap        string
-	proxy           *Core.Proxy
-	connections     sync.Map
-	encryptionTable *Encryption.Table
-	ipMap           *sync.Map
-	userMap         *sync.Map
+	username            string
+	isRunning           int32
+	keyInMap            string
+	proxy               *Core.Proxy
+	connections         sync.Map
+	encryptionTable     *Encryption.Table
+	ipMap               *sync.Map
+	userMap             *sync.Map
+	controlTcpConn      net.Conn
+	createdAt           time.Time
+	closedUploadBytes   int64
+	closedDownloadBytes int64
+	accounting          *Core.SW
+	control             *Core.ControlChannel
+	liveness            *Core.Liveness
+	timeouts            Core.Timeouts
+	limits              *limiter
+	bans                *banList
+	replay              *replayCache
+	fallback            *fallback
+	egress              *egress
+	upstreams           *upstreams
+	reverse             *reverseGrants
+	listener            *listener
+	reverseMutex        sync.Mutex
+	reverseListeners    sync.Map
+	reversePending      sync.Map
+	activeConnections   int64
+	dnsQueries          chan struct{}
 }
 
 /**
    Simple constructor for Session
 **/
-func newSession(proxy *Core.Proxy, localTcpConn *net.TCPConn, ipMap *sync.Map, userMap * sync.Map) *Session {
-	var connMap sync.Map
+func newSession(proxy *Core.Proxy, localTcpConn net.Conn, ipMap *sync.Map, userMap *sync.Map, accounting *Core.SW) *Session {
 	return &Session{
 		username:        "",
-		password:        "",
 		isRunning:       1,
 		keyInMap:        calculateKey(localTcpConn),
 		proxy:           proxy,
-		connections:     connMap,
 		encryptionTable: Encryption.NewEmptyEncryptionTable(),
 		ipMap:           ipMap,
 		userMap:         userMap,
-
+		controlTcpConn:  localTcpConn,
+		createdAt:       time.Now(),
+		accounting:      accounting,
+		dnsQueries:      make(chan struct{}, maxDNSQueries),
 	}
 }
 
+var errDuplicateUser = errors.New("Can't sign in same user name and password in the same time")
+
 /**
-   This function will read password and user name
-   And then verify those datas between our CSV database
-   It will send message to indicate success or fail
+   This function will read user name, timestamp, nonce and proof
+   And then verify the proof with password in our CSV database
+   Stale timestamp and nonce which is already used are refused, so a recorded sign in can not be replayed
+   Only a client with correct proof gets a message to indicate success or fail
+   Others get nothing, caller gives them to fallback with the bytes which are received
    This is guraantee read write because length is defined already
 **/
-func (s *Session) signInUser(localTcpConn *net.TCPConn) (bool, error) {
+func (s *Session) signInUser(localTcpConn net.Conn) (bool, []byte, error) {
 	if s.isRunning != 1 {
-		return false, errors.New("The server proxy is not running") 
+		return false, nil, errors.New("The server proxy is not running")
 	}
-	name := make([]byte, 128)
-	key := make([]byte, 128)
-	// read password and name first and then read decode , encode
-	check1, check2 := Core.ReadAll(name, localTcpConn, 128)
-	if (check1 == -1 && check2 != nil) || (check1 == 0 && check2 == nil) {
-		return false, errors.New("Username transfer is not successful")  
-	}
-	s.username = Core.ConvertByteTOString(name)
-	_, OK := s.userMap.Load(s.username)
-    if !OK {
-		s.userMap.Store(s.username,s)
-	}else{
-        check1, check2 = Core.WriteAll(Core.FAIL, localTcpConn, 3) 
-		if check1 == -1 && check2 != nil {
-			return false, errors.New("Write encouters problem when reply response")  
-		}
-		return false, errors.New("Can't sign in same user name and password in the same time")
+	nameLength := Authentication.UserNameLength
+	hexFrom := nameLength + Authentication.TimestampLength + Authentication.NonceLength
+	received := make([]byte, hexFrom+Authentication.ProofLength)
+	// read name first and then read timestamp, nonce and proof
+	// user name and proof are hex, so other clients are found before all bytes arrive
+	readLength, err := readSignIn(localTcpConn, received, 0, nameLength, 0)
+	if err != nil {
+		return false, received[:readLength], err
 	}
-	check1, check2 = Core.ReadAll(key, localTcpConn, 128)
-	if (check1 == -1 && check2 != nil) || (check1 == 0 && check2 == nil) {
-		return false, errors.New("Password transfer is not successful")  
+	s.username = Core.ConvertByteTOString(received[:nameLength])
+	readLength, err = readSignIn(localTcpConn, received, readLength, len(received), hexFrom)
+	if err != nil {
+		return false, received[:readLength], err
 	}
-	s.password = Core.ConvertByteTOString(key)
-	var ok bool
-	var err error
-	ok, err = Authentication.Verify(s.username, s.password)
+	timestamp := received[nameLength : nameLength+Authentication.TimestampLength]
+	nonce := received[nameLength+Authentication.TimestampLength : hexFrom]
+	proof := Core.ConvertByteTOString(received[hexFrom:])
+	if err := s.replay.checkTimestamp(timestamp); err != nil {
+		s.limits.metrics.reject(rejectReplay)
+		return false, received, err
+	}
+	ok, err := Authentication.VerifyProof(s.username, timestamp, nonce, proof)
 	if ok == false || err != nil {
-		check1, check2 = Core.WriteAll(Core.FAIL, localTcpConn, 3) 
+		return ok, received, err
+	}
+	// a correct proof of a banned user is refused only from an IP which failed, so failures of others can not lock the user out
+	if s.bans != nil && s.bans.isUserBanned(s.username, calculateKey(localTcpConn)) {
+		s.limits.metrics.reject(rejectBanned)
+		return false, received, errors.New("user is banned")
+	}
+	if !s.listener.isAllowed(s.username) {
+		return false, received, errUserNotAllowed
+	}
+	if err := s.replay.remember(timestamp, nonce); err != nil {
+		s.limits.metrics.reject(rejectReplay)
+		return false, received, err
+	}
+	_, OK := s.userMap.LoadOrStore(s.username, s)
+	if OK {
+		// proof is correct, so it is our local proxy and it can know the reason
+		check1, check2 := Core.WriteAll(Core.FAIL, localTcpConn, 3)
 		if check1 == -1 && check2 != nil {
-			return false, errors.New("Write encouters problem when reply response")  
+			return false, nil, errors.New("Write encouters problem when reply response")
 		}
+		return false, nil, errDuplicateUser
+	}
+	check1, check2 := Core.WriteAll(Core.SUCCESS, localTcpConn, 3)
+	if check1 == -1 && check2 != nil {
+		s.userMap.Delete(s.username)
+		return false, nil, errors.New("Write encouters problem when reply response")
+	}
+	s.ipMap.Store(s.keyInMap, s)
+	return true, nil, nil
+}
 
-	} else {
-		check1, check2  = Core.WriteAll(Core.SUCCESS, localTcpConn, 3) 
-		if check1 == -1 && check2 != nil {
-			return false, errors.New("Write encouters problem when reply response")  
+/**
+   Read sign in message into buffer from readLength until length bytes are received
+   Bytes from hexFrom must be upper case hex, otherwise it is not a local proxy
+   It returns the number of bytes which are received
+**/
+func readSignIn(localTcpConn net.Conn, buffer []byte, readLength, length, hexFrom int) (int, error) {
+	for readLength < length {
+		n, err := localTcpConn.Read(buffer[readLength:length])
+		for i := readLength; i < readLength+n; i++ {
+			if i >= hexFrom && !isUpperHex(buffer[i]) {
+				return readLength + n, errors.New("client is not a local proxy")
+			}
+		}
+		readLength += n
+		if err != nil {
+			return readLength, err
 		}
-		s.ipMap.Store(s.keyInMap, s)
 	}
-	return ok, err
+	return readLength, nil
+}
+
+func isUpperHex(b byte) bool {
+	return (b >= '0' && b <= '9') || (b >= 'A' && b <= 'F')
 }
 
 /**
@@ -115,7 +185,7 @@ func (s *Session) signInUser(localTcpConn *net.TCPConn) (bool, error) {
 	And save both tables for future transmissions
 	this is guraantee read write because length is defined already
 **/
-func (s *Session) readEncryptionTable(localTcpConn *net.TCPConn) error {
+func (s *Session) readEncryptionTable(localTcpConn net.Conn) error {
 	if s.isRunning != 1 {
 		return errors.New("The server proxy is not running") 
 	}
@@ -124,12 +194,14 @@ func (s *Session) readEncryptionTable(localTcpConn *net.TCPConn) error {
 	check1, check2 := Core.ReadAll(encode, localTcpConn, 256)
 	if (check1 == -1 && check2 != nil) {
 		s.ipMap.Delete(s.keyInMap)
+		s.userMap.Delete(s.username)
 		return errors.New("Read encounters problem when read encode table")
 	}
 	s.encryptionTable.SetEncodeArr(encode)
 	check1, check2 = Core.ReadAll(decode, localTcpConn, 256)
 	if (check1 == -1 && check2 != nil) || (check1 == 0 && check2 == nil) {
 		s.ipMap.Delete(s.keyInMap)
+		s.userMap.Delete(s.username)
 		return errors.New("Read encounters problem when read decode table")
 	}
 	s.encryptionTable.SetDecodeArr(decode)
@@ -142,11 +214,23 @@ func (s *Session) readEncryptionTable(localTcpConn *net.TCPConn) error {
    The incoming pakcet from user application will contain those
    informations. We need to get and save them for future transmission
 **/
-func (s *Session) shakeHand(localTcpConn *net.TCPConn, sw *Core.SW) error {
+func (s *Session) shakeHand(localTcpConn net.Conn, sw *Core.SW) error {
 	if s.isRunning != 1 {
 		return errors.New("The server proxy is not running")
 	}
-	var serverTcpConn *net.TCPConn
+	// a local proxy which stops in the middle of handshake can not hold this go routine
+	if err := Core.SetHandshakeDeadline(localTcpConn, s.timeouts.Handshake); err != nil {
+		return err
+	}
+	// the reply of request tells local proxy when there are too many connections
+	allowed := s.limits.acquireConnection(s)
+	started := false
+	defer func() {
+		if allowed && !started {
+			s.limits.releaseConnection(s)
+		}
+	}()
+	var serverTcpConn net.Conn
 	request := make([]byte, 2)
 	// now we expect socks5 protocol, first step is confirm socks5
 	//readLength, err := localTcpConn.Read(request)
@@ -160,7 +244,8 @@ func (s *Session) shakeHand(localTcpConn *net.TCPConn, sw *Core.SW) error {
 	decodedRequest := s.encryptionTable.Decode(request[0:readLength])
 	// we need to use proxy to
 	if decodedRequest[0] != 0x5 {
-		return errors.New("The protocol setting is not proxy5")
+		// it is not our local proxy, it gets nothing from server proxy
+		return s.fallback.reject(localTcpConn, request)
 	}
 	nextReadByte := int(decodedRequest[1])
 	request = make([]byte, nextReadByte)
@@ -188,159 +273,170 @@ func (s *Session) shakeHand(localTcpConn *net.TCPConn, sw *Core.SW) error {
 		**/
 	Logging.NormalLogger.Println("waiting for new package")
 	// clean the buffer
-	request = make([]byte, 4)
+	request = make([]byte, 3)
 	// second step is get the domain name and ip address from local
 	//readLength, err = localTcpConn.Read(request)
-	readLength, err = Core.ReadAll(request,localTcpConn ,4)
+	readLength, err = Core.ReadAll(request,localTcpConn ,3)
 	if err != nil {
 		return err
 	}
-	length := 4
-	decodedRequest = s.encryptionTable.Decode(request[0:4])
-	// only support connect as method
-	if decodedRequest[1] != 0x1 {
+	decodedRequest = s.encryptionTable.Decode(request[0:3])
+	// only support connect as method, reverse is for reverse tunnels
+	command := decodedRequest[1]
+	if command != Core.SocksConnect && command != Core.SocksReverse {
 		return  errors.New("100th connect is only support method")
 	}
-	if decodedRequest[3]==Core.IpV4{
-		// v4
-		length += 6
-		firstRequest := make([]byte, 6)
-		readLength, err = Core.ReadAll(firstRequest,localTcpConn ,6)
-		if err != nil {
-			return err
-		}
-		decodedRequest1 := s.encryptionTable.Decode(firstRequest[0:6])
-		realRequest := make([]byte, length)
-		j:=0
-		for i:=0;i<4;i++{
-			realRequest[j] = decodedRequest[i]
-			j+=1
-		}
-		for i:=0;i<6;i++{
-			realRequest[j]= decodedRequest1[i]
-			j+=1
-		}
-		tcpAddress := s.proxy.ConnectToRealServer(realRequest, length,sw)
-		serverTcpConns, err := net.DialTCP("tcp", nil, tcpAddress)
-		
-		if err != nil {
-			return err
-		}
-		serverTcpConn = serverTcpConns
-
-	
-	}else if decodedRequest[3]==Core.DomainName{
-		// domain name
-		firstRequest := make([]byte, 1)
-		// read domain's length
-		readLength, err = Core.ReadAll(firstRequest,localTcpConn ,1)
-		if err != nil {
-			return err
-		}
-		length +=1
-		decodedRequest1 := s.encryptionTable.Decode(firstRequest[0:1])
-		nextReadByte = int(decodedRequest1[0])+2
-		length +=nextReadByte
-        	secondRequest := make([]byte, nextReadByte)
-		readLength, err = Core.ReadAll(secondRequest,localTcpConn ,nextReadByte)
-		if err != nil {
-			return err
-		}
-		decodedRequest2 := s.encryptionTable.Decode(secondRequest[0:nextReadByte])
-		realRequest := make([]byte, length)
-		j:=0
-		for i:=0;i<4;i++{
-			realRequest[j] = decodedRequest[i]
-			j+=1
-		}
-		realRequest[j]= decodedRequest1[0]
-		j+=1
-		for i:=0;i<nextReadByte;i++{
-			realRequest[j]= decodedRequest2[i]
-			j+=1
-		}
-		Logging.NormalLogger.Println(realRequest)
-		tcpAddress := s.proxy.ConnectToRealServer(realRequest, length,sw)
-		serverTcpConns, err := net.DialTCP("tcp", nil, tcpAddress)
-		if err != nil {
-			return err
-		}
-		serverTcpConn = serverTcpConns
-
-	}else if decodedRequest[3]==Core.IpV6{
-			// v6
-			
-			length += 18
-			firstRequest := make([]byte, 18)
-			readLength, err = Core.ReadAll(firstRequest,localTcpConn ,18)
-			if err != nil {
-				return err
-			}
-			decodedRequest1 := s.encryptionTable.Decode(firstRequest[0:18])
-			realRequest := make([]byte, length)
-			j:=0
-			for i:=0;i<4;i++{
-				realRequest[j] = decodedRequest[i]
-				j+=1
-			}
-			for i:=0;i<18;i++{
-				realRequest[j]= decodedRequest1[i]
-				j+=1
-			}
-			tcpAddress := s.proxy.ConnectToRealServer(realRequest, length,sw)
-			serverTcpConns, err := net.DialTCP("tcp", nil, tcpAddress)
-			// add defer close
-			
-			if err != nil {
-			   return err
-			}
-			serverTcpConn = serverTcpConns
-			
+	target, err := Core.ReadSocksAddr(localTcpConn, s.encryptionTable)
+	if err != nil {
+		s.writeReply(localTcpConn, Core.SocksGeneralFailure)
+		return err
+	}
+	if command == Core.SocksReverse {
+		serverTcpConn, err = s.takeReverse(localTcpConn, target, allowed)
+	} else {
+		Logging.NormalLogger.Println("request to", target)
+		serverTcpConn, err = s.dialTarget(localTcpConn, target, sw, allowed)
+	}
+	if err != nil {
+		return err
 	}
 
-
-	response2 := []byte{0x05, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
-	encodeResponse = s.encryptionTable.Encode(response2)
-	//localTcpConn.Core.WriteAll(encodeResponse)
-	_,err = Core.WriteAll(encodeResponse, localTcpConn, 10)
-    	connection := Core.NewConnectionHandler(localTcpConn, serverTcpConn, s.proxy.GetDevice(), s.encryptionTable)
-	s.connections.Store(&connection, &connection)
+	err = s.writeReply(localTcpConn, Core.SocksSucceeded)
+	if err == nil {
+		err = Core.SetHandshakeDeadline(localTcpConn, 0)
+	}
+	if err != nil {
+		_ = serverTcpConn.Close()
+		return err
+	}
+	connection := Core.NewConnectionHandler(localTcpConn, serverTcpConn, s.proxy.GetDevice(), s.encryptionTable)
+	connection.SetTimeouts(s.timeouts.Idle, s.timeouts.Lifetime)
+	s.connections.Store(connection, connection)
+	started = true
 	go func() {
-			connection.TransferData()
-			s.connections.Delete(&connection)
+		connection.TransferData()
+		s.connections.Delete(connection)
+		s.limits.releaseConnection(s)
+		atomic.AddInt64(&s.closedUploadBytes, connection.GetUploadBytes())
+		atomic.AddInt64(&s.closedDownloadBytes, connection.GetDownloadBytes())
 	}()
+	return nil
+}
+
+/**
+  This function connects to one address of the target, or through a chain of upstream proxies,
+  unless there are too many connections
+  Local proxy gets a reply when it fails
+**/
+func (s *Session) dialTarget(localTcpConn net.Conn, target *Core.SocksAddr, sw *Core.SW, allowed bool) (net.Conn, error) {
+	if !allowed {
+		s.writeReply(localTcpConn, Core.SocksNotAllowed)
+		return nil, errors.New("too many connections")
+	}
+	dialerFor := s.egress.choose(s.username, target).dialerFor()
+	var serverTcpConn net.Conn
+	var err error
+	if chain := s.upstreams.choose(s.username, target); chain != nil {
+		// the last proxy of chain resolves domain names
+		fmt.Fprintln(sw, target.GetHost())
+		Logging.NormalLogger.Println("connect to", target, "by", chain)
+		serverTcpConn, err = chain.Dial(target.String(), s.proxy.ResolveTCPAddrs, s.timeouts, dialerFor)
+	} else {
+		tcpAddresses := s.proxy.ConnectToRealServer(target, sw)
+		serverTcpConn, err = Core.DialAddresses(tcpAddresses, s.timeouts, dialerFor)
+	}
+	if err != nil {
+		s.writeReply(localTcpConn, Core.SocksHostUnreachable)
+		return nil, err
+	}
+	return serverTcpConn, nil
+}
+
+/**
+  This function gives an encoded reply with empty bind address to local proxy
+  Local proxy passes the reply code to user application
+**/
+func (s *Session) writeReply(localTcpConn net.Conn, reply byte) error {
+	response := []byte{Core.SocksVersion, reply, 0x00, Core.IpV4, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+	encodeResponse := s.encryptionTable.Encode(response)
+	_, err := Core.WriteAll(encodeResponse, localTcpConn, len(encodeResponse))
 	return err
 }
 
+/**
+  Timeouts are set before session is shared by maps
+**/
+func (s *Session) setTimeouts(timeouts Core.Timeouts) {
+	s.timeouts = timeouts
+}
+
+/**
+  Listener is set before sign in, key in map depends on it
+**/
+func (s *Session) setListener(listener *listener) {
+	s.listener = listener
+	s.keyInMap = listener.getKey(calculateKey(s.controlTcpConn))
+}
+
+/**
+  Limiter is set before session is shared by maps
+**/
+func (s *Session) setLimits(limits *limiter) {
+	s.limits = limits
+}
+
+/**
+  Ban list and replay cache protect sign in, they are set before sign in
+  Clients which are not local proxy are given to fallback
+**/
+func (s *Session) setProtection(bans *banList, replay *replayCache, fallback *fallback) {
+	s.bans = bans
+	s.replay = replay
+	s.fallback = fallback
+}
+
+/**
+  Egress and upstreams are set before session is shared by maps
+**/
+func (s *Session) setOutbound(egress *egress, upstreams *upstreams) {
+	s.egress = egress
+	s.upstreams = upstreams
+}
+
+/**
+  Reverse grants are set before session is shared by maps
+**/
+func (s *Session) setReverse(reverse *reverseGrants) {
+	s.reverse = reverse
+}
+
+/**
+  Create control channel and liveness before session is shared by maps
+**/
+func (s *Session) setHeartBeat(interval time.Duration, missCount int) {
+	s.control = Core.NewControlChannel(s.controlTcpConn, s.encryptionTable)
+	s.liveness = Core.NewLiveness(interval, missCount)
+}
+
 /**
   This function handles a thread control and
-  Read from localproxy every 5 seconds
-  If there is no responses about heartbeat we need to close this session
+  Read ping and pong from localproxy, pings are answered
+  Server proxy also sends its own pings for measuring round trip time
+  If local proxy misses too many intervals we need to close this session
 **/
-func (s *Session) receiveHeartBeat(localTcpConn *net.TCPConn) {
-	mes := make([]byte, 3, 3)
-	for {
-		//todo need jiacheng confirm
-		if s.isRunning != 1 {
-			return
-		}
-		if err := localTcpConn.SetReadDeadline(time.Now().Add(Core.HeartBeatTimeout * time.Second)); err != nil {
-			Logging.ErrorLogger.Println("Encounter an error when set heart beat timeout")
-			break
-		}
-		check1, check2 := localTcpConn.Read(mes)
-		if check1 == -1 && check2 != nil {
-			Logging.ErrorLogger.Println("encounter a error read a message")
-			break
-		}
-		if !(Core.ByteArrEqual(mes, Core.BEAT)) {
-			Logging.ErrorLogger.Println("Server Proxy did not receive heart message")
-			break
+func (s *Session) receiveHeartBeat() {
+	stop := make(chan struct{})
+	go func() {
+		if err := Core.SendPings(s.control, s.liveness, stop); err != nil {
+			Logging.ErrorLogger.Println("Server Proxy could not send heart beat", err)
+			s.closeSession()
 		}
-		Logging.NormalLogger.Println("receive heart beat")
-		mes = make([]byte, 3, 3)
-		time.Sleep(Core.HeartBeatRate * time.Second)
+	}()
+	err := Core.ReceiveFrames(s.control, s.liveness, s.handleControl)
+	if err != nil && atomic.LoadInt32(&s.isRunning) == 1 {
+		Logging.ErrorLogger.Println("Server Proxy did not receive heart beat", err)
 	}
+	close(stop)
 	s.closeSession()
 }
 
@@ -350,13 +446,72 @@ func (s *Session) receiveHeartBeat(localTcpConn *net.TCPConn) {
   And Remove itself from IPmap
 **/
 func (s *Session) closeSession() {
-	atomic.StoreInt32(&(s.isRunning), 0)
+	if swapped := atomic.CompareAndSwapInt32(&(s.isRunning), 1, 0); !swapped {
+		return
+	}
 	s.connections.Range(closeConnection)
+	s.closeReverse()
 	s.ipMap.Delete(s.keyInMap)
 	s.userMap.Delete(s.username)
+	if err := s.controlTcpConn.Close(); err != nil {
+		Logging.ErrorLogger.Println(err)
+	}
+	s.writeAccounting()
 	Logging.NormalLogger.Println("Session closed")
 }
 
+/**
+  Write user, ip, start time, duration and bytes of this session
+  Running connections are already aborted so bytes are almost final
+**/
+func (s *Session) writeAccounting() {
+	if s.accounting == nil {
+		return
+	}
+	_, err := fmt.Fprintf(s.accounting, "%s,%s,%s,%d,%d,%d\n", s.username, s.keyInMap,
+		s.createdAt.Format(time.RFC3339), int64(time.Since(s.createdAt).Seconds()),
+		s.getUploadBytes(), s.getDownloadBytes())
+	if err != nil {
+		Logging.ErrorLogger.Println(err)
+	}
+}
+
+/**
+  This function returns all running connections of this session
+**/
+func (s *Session) getConnections() []*Core.ConnectionHandler {
+	var connections []*Core.ConnectionHandler
+	s.connections.Range(func(key interface{}, value interface{}) bool {
+		if v, ok := key.(*Core.ConnectionHandler); ok {
+			connections = append(connections, v)
+		}
+		return true
+	})
+	return connections
+}
+
+/**
+  Total upload bytes include finished and running connections
+**/
+func (s *Session) getUploadBytes() int64 {
+	total := atomic.LoadInt64(&s.closedUploadBytes)
+	for _, connection := range s.getConnections() {
+		total += connection.GetUploadBytes()
+	}
+	return total
+}
+
+/**
+  Total download bytes include finished and running connections
+**/
+func (s *Session) getDownloadBytes() int64 {
+	total := atomic.LoadInt64(&s.closedDownloadBytes)
+	for _, connection := range s.getConnections() {
+		total += connection.GetDownloadBytes()
+	}
+	return total
+}
+
 /**
   This call back function will go through all key in connection map
   and call abort for it
@@ -367,7 +522,7 @@ func closeConnection(key interface{}, value interface{}) bool {
 		return false
 	}
 	if v, ok := key.(*Core.ConnectionHandler); ok {
-		v.Abort()
+		v.Close(Core.CloseSession)
 		return true
 	}
 	return false
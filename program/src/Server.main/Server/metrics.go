@@ -0,0 +1,108 @@
+/**
+  Author: JiaCheng Yang && Wenkai Zheng
+  This file is used for metrics of server proxy
+  Metrics are shown by admin api in prometheus text format
+**/
+package Server
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+/**
+   Reasons of rejection, they are labels of mss_rejected_total
+**/
+const (
+	rejectAcceptRate = iota
+	rejectHandshakes
+	rejectConnections
+	rejectSessionConnections
+	rejectBanned
+	rejectReplay
+	rejectReasonCount
+)
+
+var rejectReasons = [rejectReasonCount]string{
+	"accept_rate",
+	"handshakes",
+	"connections",
+	"session_connections",
+	"banned",
+	"replay",
+}
+
+/**
+   Counters only increase, running numbers are read from limiter and maps
+**/
+type metrics struct {
+	accepted     int64
+	signedIn     int64
+	signInFailed int64
+	rejected     [rejectReasonCount]int64
+}
+
+/**
+   Count one accepted tcp conn
+**/
+func (m *metrics) accept() {
+	atomic.AddInt64(&m.accepted, 1)
+}
+
+/**
+   Count one successful sign in
+**/
+func (m *metrics) signIn() {
+	atomic.AddInt64(&m.signedIn, 1)
+}
+
+/**
+   Count one sign in with wrong user name or password
+**/
+func (m *metrics) signInFail() {
+	atomic.AddInt64(&m.signInFailed, 1)
+}
+
+/**
+   Count one rejection
+**/
+func (m *metrics) reject(reason int) {
+	atomic.AddInt64(&m.rejected[reason], 1)
+}
+
+/**
+   Simple getter for rejections of one reason
+**/
+func (m *metrics) getRejected(reason int) int64 {
+	return atomic.LoadInt64(&m.rejected[reason])
+}
+
+/**
+   GET /metrics
+**/
+func (a *adminServer) writeMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m := a.metrics
+	var connections, handshakes int64
+	for _, l := range a.listeners {
+		connections += l.limits.getConnections()
+		handshakes += l.limits.getHandshakes()
+	}
+	fmt.Fprintln(w, "# TYPE mss_accepted_total counter")
+	fmt.Fprintln(w, "mss_accepted_total", atomic.LoadInt64(&m.accepted))
+	fmt.Fprintln(w, "# TYPE mss_signed_in_total counter")
+	fmt.Fprintln(w, "mss_signed_in_total", atomic.LoadInt64(&m.signedIn))
+	fmt.Fprintln(w, "# TYPE mss_sign_in_failed_total counter")
+	fmt.Fprintln(w, "mss_sign_in_failed_total", atomic.LoadInt64(&m.signInFailed))
+	fmt.Fprintln(w, "# TYPE mss_rejected_total counter")
+	for reason, name := range rejectReasons {
+		fmt.Fprintf(w, "mss_rejected_total{reason=%q} %d\n", name, m.getRejected(reason))
+	}
+	fmt.Fprintln(w, "# TYPE mss_sessions gauge")
+	fmt.Fprintln(w, "mss_sessions", len(a.getSessions()))
+	fmt.Fprintln(w, "# TYPE mss_connections gauge")
+	fmt.Fprintln(w, "mss_connections", connections)
+	fmt.Fprintln(w, "# TYPE mss_handshakes gauge")
+	fmt.Fprintln(w, "mss_handshakes", handshakes)
+}
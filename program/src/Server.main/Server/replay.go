@@ -0,0 +1,72 @@
+/**
+  Author: JiaCheng Yang && Wenkai Zheng
+  This file is used for replay protection of sign in
+  Timestamp of sign in must be within clock skew of server time
+  Nonce of a sign in can only be used once while its timestamp is valid
+**/
+package Server
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+)
+
+var errStaleTimestamp = errors.New("sign in timestamp is out of clock skew")
+var errReplayedNonce = errors.New("sign in nonce is replayed")
+
+/**
+   Seen nonces and the time they can be forgotten
+   After that time the timestamp is stale, so the nonce can not be used again anyway
+**/
+type replayCache struct {
+	mutex     sync.Mutex
+	skew      time.Duration
+	seen      map[string]time.Time
+	lastSweep time.Time
+}
+
+/**
+   Simple constructor for replay cache
+**/
+func newReplayCache(skew time.Duration) *replayCache {
+	return &replayCache{skew: skew, seen: make(map[string]time.Time), lastSweep: time.Now()}
+}
+
+/**
+   Check timestamp is within clock skew
+**/
+func (r *replayCache) checkTimestamp(timestamp []byte) error {
+	sent := time.Unix(int64(binary.BigEndian.Uint64(timestamp)), 0)
+	diff := time.Since(sent)
+	if diff > r.skew || diff < -r.skew {
+		return errStaleTimestamp
+	}
+	return nil
+}
+
+/**
+   Remember a nonce, it fails when the nonce is already seen
+   It is called after the proof is verified, so random bytes can not fill the cache
+**/
+func (r *replayCache) remember(timestamp, nonce []byte) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	now := time.Now()
+	if now.Sub(r.lastSweep) > r.skew {
+		for key, expires := range r.seen {
+			if now.After(expires) {
+				delete(r.seen, key)
+			}
+		}
+		r.lastSweep = now
+	}
+	key := string(nonce)
+	if expires, ok := r.seen[key]; ok && now.Before(expires) {
+		return errReplayedNonce
+	}
+	sent := time.Unix(int64(binary.BigEndian.Uint64(timestamp)), 0)
+	r.seen[key] = sent.Add(r.skew + time.Second)
+	return nil
+}
@@ -0,0 +1,183 @@
+/**
+  Author: JiaCheng Yang && Wenkai Zheng
+  This file is used for reverse tunnels, the way ssh -R works
+  Local proxy asks server proxy on control tcp conn to listen on a port which is granted to its user
+  Each conn accepted on that port waits until local proxy takes it by a new tcp conn with reverse command
+  Then data goes the same way as a normal connection, only the target is the accepted conn
+**/
+package Server
+
+import (
+	"Authentication"
+	"Core"
+	"Logging"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/**
+  Id of an accepted conn is random, so other sessions can not guess it
+**/
+const reverseIDLength = 8
+
+/**
+  An accepted conn which is not taken in this time is closed
+**/
+const reverseWaitTimeout = 10 * time.Second
+
+/**
+  Ports which users can listen on, addr is the host which server proxy listens on
+**/
+type reverseGrants struct {
+	addr  string
+	ports map[string]map[int]bool
+}
+
+/**
+  Simple constructor for reverse grants
+  Users in config are plain user names, sessions know them by encoded names
+**/
+func newReverseGrants(config ServerConfig) *reverseGrants {
+	grants := &reverseGrants{addr: strings.Trim(config.ReverseAddr, "[]"), ports: make(map[string]map[int]bool)}
+	for user, ports := range config.ReversePorts {
+		user = Authentication.NormalizeUsername(user)
+		grants.ports[user] = make(map[int]bool)
+		for _, port := range ports {
+			grants.ports[user][port] = true
+		}
+	}
+	return grants
+}
+
+func (g *reverseGrants) isAllowed(user string, port int) bool {
+	return g != nil && g.ports[user][port]
+}
+
+/**
+  Reverse open frame, the reply tells local proxy whether server proxy listens now
+  A port which this session listens on already is fine
+  Open and close are serialized, so a listener is never kept by a session which is closed
+**/
+func (s *Session) openReverse(payload []byte) error {
+	if len(payload) != 2 {
+		return errors.New("wrong reverse open frame")
+	}
+	port := int(binary.BigEndian.Uint16(payload))
+	status := byte(Core.ReverseRefused)
+	if s.reverse.isAllowed(s.username, port) {
+		status = s.listenReverse(port)
+	} else {
+		Logging.NormalLogger.Println("reverse port", port, "is not granted to", s.username)
+	}
+	return s.control.WriteFrame(Core.ControlReverseReply, append(payload, status))
+}
+
+/**
+  Listen on a reverse port of this session, it gives the status of reverse reply
+**/
+func (s *Session) listenReverse(port int) byte {
+	s.reverseMutex.Lock()
+	defer s.reverseMutex.Unlock()
+	if _, ok := s.reverseListeners.Load(port); ok {
+		return Core.ReverseOK
+	}
+	tcpAddr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(s.reverse.addr, strconv.Itoa(port)))
+	var tcpListener *net.TCPListener
+	if err == nil {
+		tcpListener, err = net.ListenTCP("tcp", tcpAddr)
+	}
+	if err != nil {
+		Logging.ErrorLogger.Println("could not listen on reverse port", port, err)
+		return Core.ReverseFailed
+	}
+	s.reverseListeners.Store(port, tcpListener)
+	// session can be closed while listening, then close reverse has run already and missed this listener
+	if atomic.LoadInt32(&s.isRunning) != 1 {
+		s.reverseListeners.Delete(port)
+		_ = tcpListener.Close()
+		return Core.ReverseFailed
+	}
+	Logging.NormalLogger.Println("reverse tunnel of", s.username, "listens on", tcpAddr)
+	go s.acceptReverse(port, tcpListener)
+	return Core.ReverseOK
+}
+
+/**
+  Accept conns on a reverse port until the session is closed
+**/
+func (s *Session) acceptReverse(port int, tcpListener *net.TCPListener) {
+	for {
+		inboundTcpConn, err := tcpListener.AcceptTCP()
+		if err != nil {
+			return
+		}
+		if err = s.offerReverse(port, inboundTcpConn); err != nil {
+			Logging.ErrorLogger.Println(err)
+			_ = inboundTcpConn.Close()
+		}
+	}
+}
+
+/**
+  Keep an accepted conn and tell local proxy its id
+**/
+func (s *Session) offerReverse(port int, inboundTcpConn net.Conn) error {
+	random := make([]byte, reverseIDLength)
+	if _, err := rand.Read(random); err != nil {
+		return err
+	}
+	id := hex.EncodeToString(random)
+	s.reversePending.Store(id, inboundTcpConn)
+	time.AfterFunc(reverseWaitTimeout, func() {
+		if _, ok := s.reversePending.LoadAndDelete(id); ok {
+			Logging.NormalLogger.Println("reverse conn on port", port, "is not taken by local proxy")
+			_ = inboundTcpConn.Close()
+		}
+	})
+	payload := make([]byte, 2, 2+len(id))
+	binary.BigEndian.PutUint16(payload, uint16(port))
+	return s.control.WriteFrame(Core.ControlReverseConnect, append(payload, id...))
+}
+
+/**
+  Reverse command from local proxy, the accepted conn becomes the target of this connection
+**/
+func (s *Session) takeReverse(localTcpConn net.Conn, target *Core.SocksAddr, allowed bool) (net.Conn, error) {
+	if !allowed {
+		s.writeReply(localTcpConn, Core.SocksNotAllowed)
+		return nil, errors.New("too many connections")
+	}
+	value, ok := s.reversePending.LoadAndDelete(target.Name)
+	if target.Type != Core.DomainName || !ok {
+		s.writeReply(localTcpConn, Core.SocksHostUnreachable)
+		return nil, errors.New("no reverse conn " + target.Name)
+	}
+	return value.(net.Conn), nil
+}
+
+/**
+  Stop listening on reverse ports and close conns which are not taken
+**/
+func (s *Session) closeReverse() {
+	s.reverseMutex.Lock()
+	defer s.reverseMutex.Unlock()
+	s.reverseListeners.Range(func(key interface{}, value interface{}) bool {
+		s.reverseListeners.Delete(key)
+		if err := value.(*net.TCPListener).Close(); err != nil {
+			Logging.ErrorLogger.Println(err)
+		}
+		return true
+	})
+	s.reversePending.Range(func(key interface{}, value interface{}) bool {
+		s.reversePending.Delete(key)
+		_ = value.(net.Conn).Close()
+		return true
+	})
+}
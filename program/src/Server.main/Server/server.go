@@ -8,21 +8,43 @@ package Server
 import (
 	"Authentication"
 	"Core"
+	"FileParser"
 	"Logging"
+	"Resolver"
 	"net"
-	"strings"
 	"sync"
+	"sync/atomic"
 )
 
 var DataPath = "./data.csv"
+
+/**
+  Subsystems which every listener shares, they are made once by Run
+  Users signed in are kept by each listener, so they are not here
+**/
+type subsystems struct {
+	proxy      *Core.Proxy
+	sw         *Core.SW
+	ipMap      *sync.Map
+	accounting *Core.SW
+	bans       *banList
+	replay     *replayCache
+	fallback   *fallback
+	egress     *egress
+	upstreams  *upstreams
+	reverse    *reverseGrants
+}
+
 /**
-  This function is used for getting ip from x.x.x.x:n
+  This function is used for getting ip from x.x.x.x:n or [x:x::x]:n
   x.x.x.x is ip and n is port
   we used it to distinguish differnt sessions
 **/
-func calculateKey(localTcpConn *net.TCPConn) (ip string) {
+func calculateKey(localTcpConn net.Conn) (ip string) {
 	ip = localTcpConn.RemoteAddr().String()
-	ip = strings.Split(ip, ":")[0]
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
 	return
 }
 /**
@@ -32,14 +54,16 @@ func calculateKey(localTcpConn *net.TCPConn) (ip string) {
    encryption table again, and all requests need to go through shake hands
    functions for socks protocol,each request will be store in each session
    according to IP
+   Too many tcp conns from one IP and too many sign in at the same time are closed
+   Each listener runs this function with its own config, limits and transport
 **/
-func waitForNewConnection(proxy *Core.Proxy, tcpListener *net.TCPListener, sw *Core.SW) {
+func waitForNewConnection(listener *listener, shared *subsystems) {
+	config, limits, transport := listener.config, listener.limits, listener.transport
+	ipMap, bans, fallback := shared.ipMap, shared.bans, shared.fallback
 	var ip string
 	var session *Session
-	var ipMap sync.Map
-	var userMap sync.Map
 	for {
-		localTcpConn, err := tcpListener.AcceptTCP()
+		localTcpConn, err := listener.tcpListener.AcceptTCP()
 		Logging.NormalLogger.Println("ACCEPT TCP")
 		if err != nil {
 			Logging.NormalLogger.Println("encounter error when accepting TCP")
@@ -47,58 +71,255 @@ func waitForNewConnection(proxy *Core.Proxy, tcpListener *net.TCPListener, sw *C
 			return
 		}
 		ip = calculateKey(localTcpConn)
-		result, ok := ipMap.Load(ip)
+		if !limits.allowAccept(ip) {
+			Logging.NormalLogger.Println("too many tcp conns from", ip)
+			_ = localTcpConn.Close()
+			continue
+		}
+		limits.metrics.accept()
+		result, ok := ipMap.Load(listener.getKey(ip))
 		if !ok {
-			session = newSession(proxy, localTcpConn, &ipMap,&userMap)
-			if rc, err := session.signInUser(localTcpConn); rc == false || err != nil {
-				Logging.NormalLogger.Println("could not sign in user")
-				Logging.ErrorLogger.Println(err)
+			if bans.isBanned(BanIP, ip) {
+				Logging.NormalLogger.Println("banned IP", ip, "tries to sign in")
+				limits.metrics.reject(rejectBanned)
+				_ = fallback.reject(localTcpConn, nil)
 				continue
 			}
-			if err := session.readEncryptionTable(localTcpConn); err != nil {
-				Logging.NormalLogger.Println("could not get encryption table")
-				Logging.ErrorLogger.Println(err)
+			if !limits.acquireHandshake() {
+				Logging.NormalLogger.Println("too many sign in handshakes")
+				_ = localTcpConn.Close()
 				continue
 			}
-			go session.receiveHeartBeat(localTcpConn)
+			go func(localTcpConn net.Conn) {
+				localTcpConn = acceptTransport(config, transport, localTcpConn, fallback)
+				if localTcpConn == nil {
+					limits.releaseHandshake()
+					return
+				}
+				session := signInSession(listener, localTcpConn, shared)
+				limits.releaseHandshake()
+				if session != nil {
+					session.receiveHeartBeat()
+				}
+			}(localTcpConn)
 			continue
 		}
 		session = result.(*Session)
 
-		go func() {
-			if err := session.shakeHand(localTcpConn,sw); err != nil {
+		go func(session *Session, localTcpConn net.Conn) {
+			if localTcpConn = acceptTransport(config, transport, localTcpConn, fallback); localTcpConn == nil {
+				return
+			}
+			if err := session.shakeHand(localTcpConn,shared.sw); err != nil {
 				Logging.NormalLogger.Println("could not shake hands")
 				Logging.NormalLogger.Println(err)
+				if err != errRejected {
+					_ = localTcpConn.Close()
+				}
 			}
-		}()
+		}(session, localTcpConn)
+	}
+}
+
+/**
+   This function finishes transport handshake of an accepted tcp conn
+   It returns nil when the tcp conn is closed or given to fallback
+**/
+func acceptTransport(config ServerConfig, transport Core.Transport, localTcpConn net.Conn, fallback *fallback) net.Conn {
+	if err := Core.SetHandshakeDeadline(localTcpConn, config.GetTimeouts().Handshake); err != nil {
+		Logging.ErrorLogger.Println(err)
+		_ = localTcpConn.Close()
+		return nil
+	}
+	conn, received, err := transport.Accept(localTcpConn)
+	if err == nil {
+		return conn
+	}
+	Logging.NormalLogger.Println("could not finish", transport.GetName(), "transport handshake from", calculateKey(localTcpConn))
+	Logging.ErrorLogger.Println(err)
+	if received == nil || isGone(err) {
+		_ = localTcpConn.Close()
+	} else {
+		_ = fallback.reject(localTcpConn, received)
+	}
+	return nil
+}
+
+/**
+   This function signs in a new session and reads its encryption table
+   It returns nil when sign in fails
+   Sign in has a deadline, so a silent client can not hold a handshake forever
+**/
+func signInSession(listener *listener, localTcpConn net.Conn, shared *subsystems) *Session {
+	config, limits, bans, fallback := listener.config, listener.limits, shared.bans, shared.fallback
+	session := newSession(shared.proxy, localTcpConn, shared.ipMap, &listener.userMap, shared.accounting)
+	session.setListener(listener)
+	session.setHeartBeat(config.GetHeartBeatInterval(), config.GetHeartBeatMissCount())
+	session.setTimeouts(config.GetTimeouts())
+	session.setLimits(limits)
+	session.setProtection(bans, shared.replay, fallback)
+	session.setOutbound(shared.egress, shared.upstreams)
+	session.setReverse(shared.reverse)
+	if err := Core.SetHandshakeDeadline(localTcpConn, config.GetTimeouts().Handshake); err != nil {
+		Logging.ErrorLogger.Println(err)
+		_ = localTcpConn.Close()
+		return nil
+	}
+	ip := calculateKey(localTcpConn)
+	if rc, received, err := session.signInUser(localTcpConn); rc == false || err != nil {
+		Logging.NormalLogger.Println("could not sign in user from", ip)
+		if err != nil {
+			Logging.ErrorLogger.Println(err)
+		} else {
+			// wrong user name or password
+			limits.metrics.signInFail()
+			bans.fail(BanIP, ip)
+			// a name which is not in CSV can be anything, counting it would only grow the ban list
+			if Authentication.HasUser(session.username) {
+				bans.fail(BanUser, session.username)
+			}
+		}
+		if err == errDuplicateUser || received == nil || isGone(err) {
+			_ = localTcpConn.Close()
+		} else {
+			_ = fallback.reject(localTcpConn, received)
+		}
+		return nil
+	}
+	bans.succeed(ip, session.username)
+	if err := session.readEncryptionTable(localTcpConn); err != nil {
+		Logging.NormalLogger.Println("could not get encryption table")
+		Logging.ErrorLogger.Println(err)
+		session.closeSession()
+		return nil
+	}
+	if err := Core.SetHandshakeDeadline(localTcpConn, 0); err != nil {
+		Logging.ErrorLogger.Println(err)
+		session.closeSession()
+		return nil
 	}
+	limits.metrics.signIn()
+	return session
 }
 
-func Run() {
+/**
+  This function read json from server config file
+  If there is no config file we use default config
+**/
+func readJson() ServerConfig {
+	config := defaultServerConfig()
+	if err := FileParser.GetJasonConfig(ConfigPath, &config); err != nil {
+		Logging.NormalLogger.Println("use default server config")
+		return defaultServerConfig()
+	}
+	return config
+}
+
+/**
+  Main function of server proxy
+  It returns exit code, 0 means it is shut down by signal and drained
+  1 means it can not start or stops with an error
+  2 means some connections are aborted after drain timeout
+**/
+func Run() int {
 	Logging.NormalLogger.Println("server is running")
+	config := readJson()
 	Authentication.LoadCSV(DataPath)
-	proxy, err := Core.NewServerProxy(":6204") // todo may need to read from file
+	proxy, err := Core.NewServerProxy(config.GetServerAddr())
 	if err != nil {
 		Logging.NormalLogger.Println("encounter a error when starting server proxy")
-		return
+		return ExitError
 	}
 
-	// as a server for localhost
-	tcpListener, err := net.ListenTCP("tcp", proxy.GetLocalHost())
+	var ipMap sync.Map
+	serverMetrics := &metrics{}
+	// every listener listens before anything else is started
+	listeners, err := newListeners(config, serverMetrics)
 	if err != nil {
 		Logging.NormalLogger.Println("encounter error when opening TCP")
 		Logging.ErrorLogger.Println(err)
-		return
+		return ExitError
 	}
+	stopping := waitForSignal(listeners)
 
-	// add defer close
-	defer func() {
-		if err := tcpListener.Close(); err != nil {
+	bans := newBanList(config)
+	replay := newReplayCache(config.GetClockSkew())
+	fallback := newFallback(config)
+	resolver, err := Resolver.NewResolver(config.GetResolverConfig())
+	if err != nil {
+		Logging.NormalLogger.Println("encounter error when making resolver")
+		Logging.ErrorLogger.Println(err)
+		return ExitError
+	}
+	proxy.SetResolver(resolver)
+	egress, err := newEgress(config)
+	if err != nil {
+		Logging.NormalLogger.Println("encounter error when reading egress rules")
+		Logging.ErrorLogger.Println(err)
+		return ExitError
+	}
+	upstreams, err := newUpstreams(config)
+	if err != nil {
+		Logging.NormalLogger.Println("encounter error when reading upstream proxies")
+		Logging.ErrorLogger.Println(err)
+		return ExitError
+	}
+	admin, err := startAdmin(config, &ipMap, listeners, serverMetrics, bans)
+	if err != nil {
+		Logging.NormalLogger.Println("admin api is not started")
+		Logging.ErrorLogger.Println(err)
+	}
+	sw := Core.OpenFileSW("Server_Record")
+	accounting := Core.AppendFileSW(config.GetAccountingPath())
+	shared := &subsystems{
+		proxy:      proxy,
+		sw:         sw,
+		ipMap:      &ipMap,
+		accounting: accounting,
+		bans:       bans,
+		replay:     replay,
+		fallback:   fallback,
+		egress:     egress,
+		upstreams:  upstreams,
+		reverse:    newReverseGrants(config),
+	}
+	// one listener which stops with an error stops the others as well
+	stopped := make(chan struct{}, len(listeners))
+	for _, l := range listeners {
+		Logging.NormalLogger.Println("listener", l.name, "is listening on", l.getAddr(), "with", l.transport.GetName(), "transport")
+		go func(l *listener) {
+			waitForNewConnection(l, shared)
+			stopped <- struct{}{}
+		}(l)
+	}
+	<-stopped
+	if atomic.LoadInt32(stopping) == 0 {
+		if err := closeListeners(listeners); err != nil {
 			Logging.NormalLogger.Println("cannot close tcp listener")
 			Logging.ErrorLogger.Println(err)
 		}
-	}()
-    sw := Core.OpenFileSW("Server_Record")
-	waitForNewConnection(proxy, tcpListener,sw)
+	}
+	for range listeners[1:] {
+		<-stopped
+	}
 
+	code := ExitError
+	if atomic.LoadInt32(stopping) == 1 {
+		code = drain(&ipMap, config.GetDrainTimeout())
+	}
+	closeSessions(&ipMap)
+	if admin != nil {
+		if err := admin.Close(); err != nil {
+			Logging.ErrorLogger.Println(err)
+		}
+	}
+	if err := sw.Close(); err != nil {
+		Logging.ErrorLogger.Println(err)
+	}
+	bans.flush()
+	if err := accounting.Close(); err != nil {
+		Logging.ErrorLogger.Println(err)
+	}
+	Logging.NormalLogger.Println("server is stopped")
+	return code
 }
@@ -0,0 +1,249 @@
+/**
+  Author: JiaCheng Yang && Wenkai Zheng
+  This file is used for declaring struct for server config file
+  All method is used in other files
+**/
+package Server
+
+import (
+	"Core"
+	"Resolver"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/**
+   Path for server config file
+**/
+var ConfigPath = "./server_config.json"
+
+/**
+   Admin api is only started when admin token is not empty
+   Drain timeout is the seconds to wait for connections when shutting down
+   Accounting path is the file of finished sessions
+   Heartbeat interval is in seconds, local proxy is dead after miss count intervals
+   Connect, handshake, idle timeouts and max lifetime of connections are in seconds, 0 means no timeout
+   Max connections, max session connections and max handshakes are running numbers, 0 means no limit
+   Accept rate is new tcp conns per second from one IP with accept burst, 0 means no limit
+   After ban threshold failed sign ins in failure window seconds an IP or user is banned
+   for ban time seconds, every next ban is twice as long up to ban max time, bans are saved in ban path
+   Clock skew is the seconds a sign in timestamp can differ from server time
+   Clients which are not local proxy are forwarded to fallback addr, empty means they are drained until handshake timeout
+   Transport is plain, http, websocket or tls, transport path is the http path and transport host is the name in tls certificate
+   Tls cert and tls key are pem files of tls transport, a self signed certificate is made and saved there when both do not exist
+   Dns servers resolve domain names of requests (udp://ip:port, tcp://ip:port, https://host/dns-query or tls://host:853)
+   empty means name servers of the system, dns ca is a pem bundle for https and tls dns servers instead of system roots
+   Dns timeout is in seconds for each dns server, dns prefer is ipv4, ipv6, ipv4_only or ipv6_only
+   Answers are cached for their ttl up to dns max ttl, missing names up to dns negative ttl, in at most dns cache size answers
+   Hosts path is a hosts file whose names are not asked to dns servers
+   Listeners are ports with their own users, transport and limits, empty means one listener of top level fields
+**/
+type ServerConfig struct {
+	ServerAddr            string           `json:"server_addr"`
+	ServerPort            int              `json:"server_port"`
+	AdminAddr             string           `json:"admin_addr"`
+	AdminToken            string           `json:"admin_token"`
+	DrainTimeout          int              `json:"drain_timeout"`
+	AccountingPath        string           `json:"accounting_path"`
+	HeartBeatInterval     int              `json:"heartbeat_interval"`
+	HeartBeatMissCount    int              `json:"heartbeat_miss_count"`
+	ConnectTimeout        int              `json:"connect_timeout"`
+	ConnectAttemptDelay   int              `json:"connect_attempt_delay"`
+	HandshakeTimeout      int              `json:"handshake_timeout"`
+	IdleTimeout           int              `json:"idle_timeout"`
+	MaxLifetime           int              `json:"max_lifetime"`
+	MaxConnections        int              `json:"max_connections"`
+	MaxSessionConnections int              `json:"max_session_connections"`
+	MaxHandshakes         int              `json:"max_handshakes"`
+	AcceptRate            int              `json:"accept_rate"`
+	AcceptBurst           int              `json:"accept_burst"`
+	BanPath               string           `json:"ban_path"`
+	BanThreshold          int              `json:"ban_threshold"`
+	BanTime               int              `json:"ban_time"`
+	BanMaxTime            int              `json:"ban_max_time"`
+	FailureWindow         int              `json:"failure_window"`
+	ClockSkew             int              `json:"clock_skew"`
+	FallbackAddr          string           `json:"fallback_addr"`
+	Transport             string           `json:"transport"`
+	TransportPath         string           `json:"transport_path"`
+	TransportHost         string           `json:"transport_host"`
+	TLSCert               string           `json:"tls_cert"`
+	TLSKey                string           `json:"tls_key"`
+	DNSServers            []string         `json:"dns_servers"`
+	DNSCA                 string           `json:"dns_ca"`
+	DNSTimeout            int              `json:"dns_timeout"`
+	DNSPrefer             string           `json:"dns_prefer"`
+	DNSCacheSize          int              `json:"dns_cache_size"`
+	DNSMaxTTL             int              `json:"dns_max_ttl"`
+	DNSNegativeTTL        int              `json:"dns_negative_ttl"`
+	HostsPath             string           `json:"hosts_path"`
+	EgressAddresses       []string         `json:"egress_addresses"`
+	EgressInterface       string           `json:"egress_interface"`
+	EgressRules           []EgressRule     `json:"egress_rules"`
+	UpstreamChain         []string         `json:"upstream_chain"`
+	UpstreamRules         []UpstreamRule   `json:"upstream_rules"`
+	ReverseAddr           string           `json:"reverse_addr"`
+	ReversePorts          map[string][]int `json:"reverse_ports"`
+	Listeners             []ListenerConfig `json:"listeners"`
+}
+
+/**
+   Default config is used when there is no config file
+**/
+func defaultServerConfig() ServerConfig {
+	return ServerConfig{
+		ServerAddr:            "",
+		ServerPort:            6204,
+		AdminAddr:             "127.0.0.1:6205",
+		AdminToken:            "",
+		DrainTimeout:          30,
+		AccountingPath:        "Server_Accounting",
+		HeartBeatInterval:     Core.DefaultHeartBeatInterval,
+		HeartBeatMissCount:    Core.DefaultHeartBeatMissCount,
+		ConnectTimeout:        Core.DefaultConnectTimeout,
+		ConnectAttemptDelay:   int(Core.DefaultAttemptDelay / time.Millisecond),
+		HandshakeTimeout:      Core.DefaultHandshakeTimeout,
+		IdleTimeout:           Core.DefaultIdleTimeout,
+		MaxLifetime:           Core.DefaultLifetime,
+		MaxConnections:        4096,
+		MaxSessionConnections: 1024,
+		MaxHandshakes:         64,
+		AcceptRate:            100,
+		AcceptBurst:           200,
+		BanPath:               "Server_Bans.json",
+		BanThreshold:          5,
+		BanTime:               60,
+		BanMaxTime:            86400,
+		FailureWindow:         900,
+		ClockSkew:             120,
+		FallbackAddr:          "",
+		Transport:             Core.TransportPlain,
+		TransportPath:         "/",
+		TransportHost:         "",
+		TLSCert:               "Server_TLS_Cert.pem",
+		TLSKey:                "Server_TLS_Key.pem",
+		DNSServers:            []string{},
+		DNSCA:                 "",
+		DNSTimeout:            5,
+		DNSPrefer:             Resolver.PreferIPv4,
+		DNSCacheSize:          4096,
+		DNSMaxTTL:             3600,
+		DNSNegativeTTL:        30,
+		HostsPath:             "Server_Hosts",
+		EgressAddresses:       []string{},
+		EgressInterface:       "",
+		EgressRules:           []EgressRule{},
+		UpstreamChain:         []string{},
+		UpstreamRules:         []UpstreamRule{},
+		ReverseAddr:           "",
+		ReversePorts:          map[string][]int{},
+		Listeners:             []ListenerConfig{},
+	}
+}
+
+/**
+  Simple getter for server addr
+  Empty server addr listens on all addresses of ipv4 and ipv6, "0.0.0.0" only on ipv4
+**/
+func (c ServerConfig) GetServerAddr() string {
+	return net.JoinHostPort(strings.Trim(c.ServerAddr, "[]"), strconv.Itoa(c.ServerPort))
+}
+
+/**
+  Simple getter for admin addr
+**/
+func (c ServerConfig) GetAdminAddr() string {
+	return c.AdminAddr
+}
+
+/**
+  Simple getter for admin token
+**/
+func (c ServerConfig) GetAdminToken() string {
+	return c.AdminToken
+}
+
+/**
+  Simple getter for drain timeout
+**/
+func (c ServerConfig) GetDrainTimeout() time.Duration {
+	return time.Duration(c.DrainTimeout) * time.Second
+}
+
+/**
+  Simple getter for accounting path
+**/
+func (c ServerConfig) GetAccountingPath() string {
+	return c.AccountingPath
+}
+
+/**
+  Simple getter for heartbeat interval
+**/
+func (c ServerConfig) GetHeartBeatInterval() time.Duration {
+	if c.HeartBeatInterval <= 0 {
+		return Core.DefaultHeartBeatInterval * time.Second
+	}
+	return time.Duration(c.HeartBeatInterval) * time.Second
+}
+
+/**
+  Simple getter for heartbeat miss count
+**/
+func (c ServerConfig) GetHeartBeatMissCount() int {
+	if c.HeartBeatMissCount <= 0 {
+		return Core.DefaultHeartBeatMissCount
+	}
+	return c.HeartBeatMissCount
+}
+
+/**
+  Simple getter for timeouts of connections
+  Connect timeout covers all attempts to a target, connect attempt delay is in milliseconds
+**/
+func (c ServerConfig) GetTimeouts() Core.Timeouts {
+	timeouts := Core.NewTimeouts(c.ConnectTimeout, c.HandshakeTimeout, c.IdleTimeout, c.MaxLifetime)
+	timeouts.AttemptDelay = time.Duration(c.ConnectAttemptDelay) * time.Millisecond
+	return timeouts
+}
+
+/**
+  Simple getter for clock skew, it is at least 1 second
+**/
+func (c ServerConfig) GetClockSkew() time.Duration {
+	if c.ClockSkew <= 0 {
+		return time.Second
+	}
+	return time.Duration(c.ClockSkew) * time.Second
+}
+
+/**
+  Simple getter for transport options
+**/
+func (c ServerConfig) GetTransportConfig() Core.TransportConfig {
+	return Core.TransportConfig{
+		Name:     c.Transport,
+		Path:     c.TransportPath,
+		Host:     c.TransportHost,
+		CertFile: c.TLSCert,
+		KeyFile:  c.TLSKey,
+	}
+}
+
+/**
+  Simple getter for resolver config
+**/
+func (c ServerConfig) GetResolverConfig() Resolver.Config {
+	return Resolver.Config{
+		Servers:     c.DNSServers,
+		CAFile:      c.DNSCA,
+		Timeout:     time.Duration(c.DNSTimeout) * time.Second,
+		Prefer:      c.DNSPrefer,
+		HostsPath:   c.HostsPath,
+		CacheSize:   c.DNSCacheSize,
+		NegativeTTL: time.Duration(c.DNSNegativeTTL) * time.Second,
+		MaxTTL:      time.Duration(c.DNSMaxTTL) * time.Second,
+	}
+}
@@ -0,0 +1,97 @@
+/**
+  Author: JiaCheng Yang && Wenkai Zheng
+  This file is used for shutting down server proxy gracefully
+  It stops accepting, waits for running connections and closes sessions
+**/
+package Server
+
+import (
+	"Logging"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+/**
+  Exit codes of server proxy
+**/
+const (
+	ExitOK      = 0
+	ExitError   = 1
+	ExitAborted = 2
+)
+
+/**
+  How often drain checks running connections
+**/
+const drainInterval = 100 * time.Millisecond
+
+/**
+  This function waits for SIGINT or SIGTERM in another go routine
+  And closes all listeners so that accepting stops
+  The returned flag becomes 1 after a signal is received
+**/
+func waitForSignal(listeners []*listener) *int32 {
+	var stopping int32
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		Logging.NormalLogger.Println("receive", sig, "stop accepting new connections")
+		atomic.StoreInt32(&stopping, 1)
+		if err := closeListeners(listeners); err != nil {
+			Logging.ErrorLogger.Println(err)
+		}
+		// a second signal does not wait anymore
+		sig = <-signals
+		Logging.NormalLogger.Println("receive", sig, "again, exit now")
+		os.Exit(ExitAborted)
+	}()
+	return &stopping
+}
+
+/**
+  Count running connections of all sessions
+**/
+func countConnections(ipMap *sync.Map) int {
+	count := 0
+	ipMap.Range(func(key interface{}, value interface{}) bool {
+		count += len(value.(*Session).getConnections())
+		return true
+	})
+	return count
+}
+
+/**
+  This function lets running connections finish until timeout
+  It returns the exit code for Run
+**/
+func drain(ipMap *sync.Map, timeout time.Duration) int {
+	deadline := time.Now().Add(timeout)
+	for {
+		count := countConnections(ipMap)
+		if count == 0 {
+			Logging.NormalLogger.Println("all connections are drained")
+			return ExitOK
+		}
+		if time.Now().After(deadline) {
+			Logging.NormalLogger.Println("drain timeout,", count, "connections are aborted")
+			return ExitAborted
+		}
+		time.Sleep(drainInterval)
+	}
+}
+
+/**
+  Close every session, running connections are aborted
+  And accounting records are written
+**/
+func closeSessions(ipMap *sync.Map) {
+	ipMap.Range(func(key interface{}, value interface{}) bool {
+		value.(*Session).closeSession()
+		return true
+	})
+}
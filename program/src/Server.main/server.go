@@ -4,10 +4,13 @@
 **/
 package main
 
-import "Server.main/Server"
+import (
+	"Server.main/Server"
+	"os"
+)
 
 func main() {
 	// todo run with argument
 	// todo 注册用户
-	Server.Run()
+	os.Exit(Server.Run())
 }